@@ -0,0 +1,178 @@
+package engine
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/anacrolix/torrent"
+	"github.com/anacrolix/torrent/metainfo"
+)
+
+// AddOptions are applied to a torrent as it's added
+type AddOptions struct {
+	//directory relative to the download directory (file and mmap storage only)
+	SavePath string
+	//don't start downloading once the torrent info is loaded
+	Paused bool
+	Labels []string
+	//file paths to download, all files when empty
+	Files    []string
+	Trackers []string
+	WebSeeds []string
+	//force private mode (tracker-only peer discovery)
+	Private bool
+	//merge trackers and web seeds into an existing torrent
+	//(of the same owner)
+	Merge bool
+	//user who added the torrent
+	Owner string
+}
+
+// ExistsError is returned when adding a torrent which
+// the engine already has
+type ExistsError struct {
+	InfoHash string
+	//trackers and web seeds were merged into it
+	Merged bool
+}
+
+func (e *ExistsError) Error() string {
+	return fmt.Sprintf("Torrent already exists (%s)", e.InfoHash)
+}
+
+// savePaths holds the per-torrent directories used by file
+// storage, it has its own lock since anacrolix reads it
+type savePaths struct {
+	mut   sync.RWMutex
+	paths map[metainfo.Hash]string
+}
+
+func (s *savePaths) set(ih metainfo.Hash, path string) {
+	s.mut.Lock()
+	if s.paths == nil {
+		s.paths = map[metainfo.Hash]string{}
+	}
+	if path == "" {
+		delete(s.paths, ih)
+	} else {
+		s.paths[ih] = path
+	}
+	s.mut.Unlock()
+}
+
+// torrentDir is the anacrolix file storage TorrentDirMaker
+func (s *savePaths) torrentDir(baseDir string, info *metainfo.Info, ih metainfo.Hash) string {
+	s.mut.RLock()
+	defer s.mut.RUnlock()
+	return filepath.Join(baseDir, s.paths[ih])
+}
+
+func (e *Engine) NewMagnet(magnetURI string) error {
+	_, err := e.AddMagnet(magnetURI, AddOptions{
+		Private: e.config.PrivateMagnets,
+		Merge:   e.config.MergeDuplicates,
+	})
+	return err
+}
+
+func (e *Engine) NewTorrent(spec *torrent.TorrentSpec) error {
+	_, err := e.AddTorrent(spec, AddOptions{Merge: e.config.MergeDuplicates})
+	return err
+}
+
+func (e *Engine) AddMagnet(magnetURI string, opts AddOptions) (*Torrent, error) {
+	spec, err := torrent.TorrentSpecFromMagnetUri(magnetURI)
+	if err != nil {
+		return nil, err
+	}
+	return e.AddTorrent(spec, opts)
+}
+
+// AddTorrent adds the torrent described by spec, returning its
+// engine torrent (which may not have its info loaded yet). When
+// the torrent already exists, it's returned with an *ExistsError.
+func (e *Engine) AddTorrent(spec *torrent.TorrentSpec, opts AddOptions) (*Torrent, error) {
+	if opts.SavePath != "" {
+		if !e.config.FileStorage() {
+			return nil, fmt.Errorf("Save path requires file or mmap storage")
+		}
+		if !filepath.IsLocal(filepath.Clean(opts.SavePath)) {
+			return nil, fmt.Errorf("Invalid save path (%s)", opts.SavePath)
+		}
+	}
+	for _, u := range opts.WebSeeds {
+		if err := validWebSeed(u); err != nil {
+			return nil, err
+		}
+	}
+	if len(opts.Trackers) > 0 {
+		spec.Trackers = append(spec.Trackers, opts.Trackers)
+	}
+	spec.Webseeds = append(spec.Webseeds, opts.WebSeeds...)
+	//the check and the add are one step, so concurrent
+	//adds of the same torrent can't both apply their options
+	e.mut.Lock()
+	if t, ok := e.ts[spec.InfoHash.HexString()]; ok {
+		//users only merge into their own torrents
+		merged := opts.Merge && t.Owner == opts.Owner
+		if merged {
+			e.mergeTorrent(t, spec)
+		}
+		e.mut.Unlock()
+		return t, &ExistsError{InfoHash: t.InfoHash, Merged: merged}
+	}
+	if opts.SavePath != "" {
+		e.savePaths.set(spec.InfoHash, filepath.Clean(opts.SavePath))
+	}
+	tt, _, err := e.client.AddTorrentSpec(spec)
+	if err != nil {
+		e.mut.Unlock()
+		return nil, err
+	}
+	t := e.upsertTorrent(tt)
+	//web seeds from the magnet "ws" param, metainfo "url-list" and options
+	t.addWebSeeds(spec.Webseeds)
+	if opts.SavePath != "" {
+		t.SavePath = filepath.Clean(opts.SavePath)
+	}
+	if len(opts.Labels) > 0 {
+		t.Labels = opts.Labels
+	}
+	t.Owner = opts.Owner
+	if len(opts.Files) > 0 {
+		t.selected = map[string]bool{}
+		for _, f := range opts.Files {
+			t.selected[strings.TrimPrefix(f, "/")] = true
+		}
+	}
+	if opts.Private {
+		t.forcePrivate = true
+		t.updatePrivate()
+		e.private.set(tt.InfoHash(), true)
+	}
+	e.mut.Unlock()
+	if !t.Private && !e.killed.Load() {
+		go announceTorrent(tt, e.client.DhtServers(), e.done)
+	}
+	if !opts.Paused {
+		go func() {
+			<-tt.GotInfo()
+			e.StartTorrent(t.InfoHash)
+		}()
+	}
+	return t, nil
+}
+
+// mergeTorrent adds the trackers and web seeds
+// of spec to the existing torrent t
+func (e *Engine) mergeTorrent(t *Torrent, spec *torrent.TorrentSpec) {
+	if len(spec.Trackers) > 0 {
+		t.t.AddTrackers(spec.Trackers)
+	}
+	if len(spec.Webseeds) > 0 {
+		t.t.AddWebSeeds(spec.Webseeds)
+		t.addWebSeeds(spec.Webseeds)
+	}
+}
@@ -0,0 +1,80 @@
+package engine
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+)
+
+const testMagnet = "magnet:?xt=urn:btih:c12fe1c06bba254a9dc9f519b335aa7c1367a88a&dn=test"
+
+func testEngine(t *testing.T) *Engine {
+	t.Helper()
+	port, l := freePort(t)
+	l.Close()
+	e := New()
+	if err := e.Configure(testConfig(t, port)); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(e.stop)
+	return e
+}
+
+func TestAddTorrentConcurrent(t *testing.T) {
+	e := testEngine(t)
+	const n = 10
+	var wg sync.WaitGroup
+	errs := make([]error, n)
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			_, errs[i] = e.AddMagnet(testMagnet, AddOptions{Paused: true, Labels: []string{fmt.Sprint(i)}})
+		}(i)
+	}
+	wg.Wait()
+	added := -1
+	for i, err := range errs {
+		if err == nil {
+			if added >= 0 {
+				t.Fatalf("torrent added twice (%d and %d)", added, i)
+			}
+			added = i
+		} else if !errors.As(err, new(*ExistsError)) {
+			t.Fatal(err)
+		}
+	}
+	if added < 0 {
+		t.Fatal("torrent not added")
+	}
+	e.mut.Lock()
+	labels := e.ts["c12fe1c06bba254a9dc9f519b335aa7c1367a88a"].Labels
+	e.mut.Unlock()
+	if len(labels) != 1 || labels[0] != fmt.Sprint(added) {
+		t.Fatalf("expected the labels of add %d, got %v", added, labels)
+	}
+}
+
+func TestAddTorrentMergeOwner(t *testing.T) {
+	e := testEngine(t)
+	if _, err := e.AddMagnet(testMagnet, AddOptions{Paused: true, Owner: "alice"}); err != nil {
+		t.Fatal(err)
+	}
+	merge := func(owner, ws string) []string {
+		t.Helper()
+		tt, err := e.AddMagnet(testMagnet, AddOptions{Paused: true, Owner: owner, Merge: true, WebSeeds: []string{ws}})
+		if !errors.As(err, new(*ExistsError)) {
+			t.Fatalf("expected exists error, got %v", err)
+		}
+		e.mut.Lock()
+		defer e.mut.Unlock()
+		return append([]string{}, tt.WebSeeds...)
+	}
+	if ws := merge("bob", "http://bob.example/"); len(ws) != 0 {
+		t.Fatalf("expected no merge into another user's torrent, got %v", ws)
+	}
+	if ws := merge("alice", "http://alice.example/"); len(ws) != 1 || ws[0] != "http://alice.example/" {
+		t.Fatalf("expected the owner's web seed, got %v", ws)
+	}
+}
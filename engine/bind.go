@@ -0,0 +1,146 @@
+package engine
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// how often to check the bound interface for the kill switch
+const bindCheck = 5 * time.Second
+
+// errKilled is returned for anything attempted
+// while the kill switch is engaged
+var errKilled = errors.New("Kill switch engaged, bound address is missing")
+
+// bindHosts are the addresses peer sockets are bound to,
+// resolved from Config.ListenAddress or Config.Interface
+type bindHosts struct {
+	bound  bool
+	v4, v6 string
+}
+
+func resolveBind(c Config) (bindHosts, error) {
+	b := bindHosts{}
+	if c.DisableIPv4 && c.DisableIPv6 {
+		return b, fmt.Errorf("IPv4 and IPv6 cannot both be disabled")
+	}
+	if c.ListenAddress != "" && c.Interface != "" {
+		return b, fmt.Errorf("Set either a listen address or an interface, not both")
+	}
+	var ips []net.IP
+	if c.ListenAddress != "" {
+		ip := net.ParseIP(c.ListenAddress)
+		if ip == nil {
+			return b, fmt.Errorf("Invalid listen address (%s)", c.ListenAddress)
+		}
+		ips = []net.IP{ip}
+	} else if c.Interface != "" {
+		iface, err := net.InterfaceByName(c.Interface)
+		if err != nil {
+			return b, fmt.Errorf("Invalid interface (%s): %s", c.Interface, err)
+		}
+		if iface.Flags&net.FlagUp == 0 {
+			return b, fmt.Errorf("Interface %s is down", c.Interface)
+		}
+		addrs, err := iface.Addrs()
+		if err != nil {
+			return b, fmt.Errorf("Invalid interface (%s): %s", c.Interface, err)
+		}
+		for _, a := range addrs {
+			if ipnet, ok := a.(*net.IPNet); ok {
+				ips = append(ips, ipnet.IP)
+			}
+		}
+	} else {
+		return b, nil
+	}
+	b.bound = true
+	for _, ip := range ips {
+		if ip.To4() != nil {
+			if b.v4 == "" && !c.DisableIPv4 {
+				b.v4 = ip.String()
+			}
+		} else if b.v6 == "" && !c.DisableIPv6 && !ip.IsLinkLocalUnicast() {
+			//link-local addresses need a zone to bind
+			b.v6 = ip.String()
+		}
+	}
+	if b.v4 == "" && b.v6 == "" {
+		return b, fmt.Errorf("No usable address to bind to")
+	}
+	return b, nil
+}
+
+// listenHost is used as the anacrolix ListenHost, networks
+// without a bound address are disabled in Configure
+func (b bindHosts) listenHost(network string) string {
+	if strings.HasSuffix(network, "6") {
+		return b.v6
+	}
+	return b.v4
+}
+
+// watchBind pauses all torrents when the bound address
+// disappears, and resumes them once it returns
+func (e *Engine) watchBind(c Config, hosts bindHosts, done chan struct{}) {
+	for {
+		select {
+		case <-done:
+			return
+		case <-time.After(bindCheck):
+		}
+		current, err := resolveBind(c)
+		present := err == nil && current == hosts
+		e.mut.Lock()
+		if !present && !e.killed.Load() {
+			log.Printf("Bound address lost, kill switch pausing all torrents")
+			e.killed.Store(true)
+			for _, t := range e.ts {
+				t.pause()
+			}
+		} else if present && e.killed.Load() {
+			log.Printf("Bound address restored, resuming torrents")
+			e.killed.Store(false)
+			for _, t := range e.ts {
+				t.resume()
+			}
+		}
+		e.mut.Unlock()
+	}
+}
+
+// killSwitchDial is the tracker dialer, failing
+// while the kill switch is engaged
+func (e *Engine) killSwitchDial(ctx context.Context, network, addr string) (net.Conn, error) {
+	if e.killed.Load() {
+		return nil, errKilled
+	}
+	var d net.Dialer
+	return d.DialContext(ctx, network, addr)
+}
+
+// killSwitchListenPacket opens the sockets of udp tracker
+// announces, failing while the kill switch is engaged
+func (e *Engine) killSwitchListenPacket(network, addr string) (net.PacketConn, error) {
+	if e.killed.Load() {
+		return nil, errKilled
+	}
+	return net.ListenPacket(network, addr)
+}
+
+// killSwitchTransport wraps t, failing requests
+// while the kill switch is engaged
+func (e *Engine) killSwitchTransport(t http.RoundTripper) http.RoundTripper {
+	return roundTripper(func(r *http.Request) (*http.Response, error) {
+		if e.killed.Load() {
+			return nil, errKilled
+		}
+		return t.RoundTrip(r)
+	})
+}
@@ -0,0 +1,248 @@
+package engine
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/anacrolix/torrent/iplist"
+)
+
+const (
+	//how often to check a blocklist file for changes
+	blocklistCheck = 1 * time.Minute
+	//how often to refetch a blocklist url
+	blocklistRefresh = 24 * time.Hour
+)
+
+// blocklist is the iplist.Ranger handed to anacrolix/torrent.
+// its lists can be swapped out while the client is running,
+// and it counts the peer addresses it has rejected.
+type blocklist struct {
+	mut       sync.RWMutex
+	v4, v6    *iplist.IPList
+	rejected  int64
+	transport http.RoundTripper
+}
+
+func (b *blocklist) Lookup(ip net.IP) (r iplist.Range, ok bool) {
+	b.mut.RLock()
+	if v4 := ip.To4(); v4 != nil {
+		r, ok = b.v4.Lookup(v4)
+	} else {
+		r, ok = b.v6.Lookup(ip)
+	}
+	b.mut.RUnlock()
+	if ok {
+		atomic.AddInt64(&b.rejected, 1)
+	}
+	return
+}
+
+func (b *blocklist) NumRanges() int {
+	b.mut.RLock()
+	defer b.mut.RUnlock()
+	return b.v4.NumRanges() + b.v6.NumRanges()
+}
+
+func (b *blocklist) Rejected() int64 {
+	return atomic.LoadInt64(&b.rejected)
+}
+
+func (b *blocklist) set(v4, v6 *iplist.IPList) {
+	b.mut.Lock()
+	b.v4 = v4
+	b.v6 = v6
+	b.mut.Unlock()
+}
+
+// load reads the blocklist from src, a file path or http(s) url
+func (b *blocklist) load(src string) error {
+	var r io.ReadCloser
+	if isURL(src) {
+		client := http.Client{Timeout: 5 * time.Minute, Transport: b.transport}
+		resp, err := client.Get(src)
+		if err != nil {
+			return err
+		}
+		if resp.StatusCode != http.StatusOK {
+			resp.Body.Close()
+			return fmt.Errorf("Blocklist download failed: %s", resp.Status)
+		}
+		r = resp.Body
+	} else {
+		f, err := os.Open(src)
+		if err != nil {
+			return err
+		}
+		r = f
+	}
+	defer r.Close()
+	v4, v6, err := parseBlocklist(r)
+	if err != nil {
+		return err
+	}
+	b.set(v4, v6)
+	return nil
+}
+
+// watch reloads the blocklist when its file changes,
+// or periodically when it's a url, until done is closed
+func (b *blocklist) watch(src string, done chan struct{}) {
+	var modified time.Time
+	if info, err := os.Stat(src); err == nil {
+		modified = info.ModTime()
+	}
+	fetched := time.Now()
+	for {
+		select {
+		case <-done:
+			return
+		case <-time.After(blocklistCheck):
+		}
+		if isURL(src) {
+			if time.Since(fetched) < blocklistRefresh {
+				continue
+			}
+			fetched = time.Now()
+		} else {
+			info, err := os.Stat(src)
+			if err != nil || info.ModTime().Equal(modified) {
+				continue
+			}
+			modified = info.ModTime()
+		}
+		if err := b.load(src); err != nil {
+			log.Printf("Blocklist reload failed: %s", err)
+			continue
+		}
+		log.Printf("Reloaded blocklist (%d ranges)", b.NumRanges())
+	}
+}
+
+// parseBlocklist accepts PeerGuardian (P2P), eMule (DAT)
+// or CIDR format lines, optionally gzipped
+func parseBlocklist(r io.Reader) (v4, v6 *iplist.IPList, err error) {
+	br := bufio.NewReader(r)
+	if magic, _ := br.Peek(2); bytes.Equal(magic, []byte{0x1f, 0x8b}) {
+		gz, err := gzip.NewReader(br)
+		if err != nil {
+			return nil, nil, err
+		}
+		defer gz.Close()
+		br = bufio.NewReader(gz)
+	}
+	var ranges4, ranges6 []iplist.Range
+	scanner := bufio.NewScanner(br)
+	lineNum := 0
+	for scanner.Scan() {
+		lineNum++
+		line := bytes.TrimSpace(scanner.Bytes())
+		var rng iplist.Range
+		if len(line) == 0 || line[0] == '#' {
+			continue
+		} else if _, ipnet, err := net.ParseCIDR(string(line)); err == nil {
+			rng.First = ipnet.IP
+			rng.Last = iplist.IPNetLast(ipnet)
+		} else if r, ok, blocked, err := parseDATLine(line); ok {
+			if err != nil {
+				return nil, nil, fmt.Errorf("Blocklist error on line %d: %s", lineNum, err)
+			} else if !blocked {
+				continue
+			}
+			rng = r
+		} else if r, ok, err := iplist.ParseBlocklistP2PLine(line); err != nil {
+			return nil, nil, fmt.Errorf("Blocklist error on line %d: %s", lineNum, err)
+		} else if ok {
+			rng = r
+		} else {
+			continue
+		}
+		if first := rng.First.To4(); first != nil {
+			rng.First = first
+			rng.Last = rng.Last.To4()
+			ranges4 = append(ranges4, rng)
+		} else {
+			ranges6 = append(ranges6, rng)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, nil, err
+	}
+	return newIPList(ranges4), newIPList(ranges6), nil
+}
+
+// parseDATLine parses an eMule ipfilter.dat line,
+// "001.002.003.004 - 001.002.003.255 , 000 , description".
+// ok is false when the line isn't in this format, and ranges
+// with an access level of 128 or more aren't blocked
+func parseDATLine(line []byte) (r iplist.Range, ok, blocked bool, err error) {
+	fields := strings.SplitN(string(line), ",", 3)
+	ips := strings.TrimSpace(fields[0])
+	if len(fields) < 2 || strings.Trim(ips, "0123456789.- ") != "" {
+		return
+	}
+	ok = true
+	first, last, found := strings.Cut(ips, "-")
+	if !found {
+		err = fmt.Errorf("missing hyphen")
+		return
+	}
+	if r.First, err = parseDATIP(first); err != nil {
+		return
+	}
+	if r.Last, err = parseDATIP(last); err != nil {
+		return
+	}
+	level, err := strconv.Atoi(strings.TrimSpace(fields[1]))
+	if err != nil {
+		err = fmt.Errorf("bad level %q", strings.TrimSpace(fields[1]))
+		return
+	}
+	if len(fields) == 3 {
+		r.Description = strings.TrimSpace(fields[2])
+	}
+	blocked = level < 128
+	return
+}
+
+// parseDATIP parses an ipv4 address, DAT files
+// zero pad each part (which net.ParseIP rejects)
+func parseDATIP(s string) (net.IP, error) {
+	parts := strings.Split(strings.TrimSpace(s), ".")
+	if len(parts) != 4 {
+		return nil, fmt.Errorf("bad IP %q", strings.TrimSpace(s))
+	}
+	ip := make(net.IP, 4)
+	for i, p := range parts {
+		n, err := strconv.ParseUint(p, 10, 8)
+		if err != nil {
+			return nil, fmt.Errorf("bad IP %q", strings.TrimSpace(s))
+		}
+		ip[i] = byte(n)
+	}
+	return ip, nil
+}
+
+func newIPList(ranges []iplist.Range) *iplist.IPList {
+	sort.Slice(ranges, func(i, j int) bool {
+		return bytes.Compare(ranges[i].First, ranges[j].First) < 0
+	})
+	return iplist.New(ranges)
+}
+
+func isURL(s string) bool {
+	return strings.HasPrefix(s, "http://") || strings.HasPrefix(s, "https://")
+}
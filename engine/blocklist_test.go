@@ -0,0 +1,89 @@
+package engine
+
+import (
+	"bytes"
+	"compress/gzip"
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestParseBlocklist(t *testing.T) {
+	gzipped := func(s string) string {
+		b := bytes.Buffer{}
+		gz := gzip.NewWriter(&b)
+		gz.Write([]byte(s))
+		gz.Close()
+		return b.String()
+	}
+	for _, c := range []struct {
+		name, list string
+		blocked    []string
+		allowed    []string
+	}{
+		{
+			name:    "dat",
+			list:    "001.002.003.004 - 001.002.003.255 , 000 , Some org, Inc\n010.000.000.000 - 010.255.255.255 , 127 , private\n",
+			blocked: []string{"1.2.3.4", "1.2.3.255", "10.1.2.3"},
+			allowed: []string{"1.2.3.3", "1.2.4.0", "11.0.0.0"},
+		},
+		{
+			name:    "dat allowed level",
+			list:    "001.002.003.000 - 001.002.003.255 , 128 , allowed\n005.006.007.008 - 005.006.007.008 , 50\n",
+			blocked: []string{"5.6.7.8"},
+			allowed: []string{"1.2.3.4"},
+		},
+		{
+			name:    "p2p",
+			list:    "Some org: Inc:1.2.3.4-1.2.3.255\nother - org:5.6.7.8-5.6.7.9\n",
+			blocked: []string{"1.2.3.4", "5.6.7.9"},
+			allowed: []string{"1.2.3.3", "5.6.7.10"},
+		},
+		{
+			name:    "cidr",
+			list:    "1.2.3.0/24\n2001:db8::/32\n",
+			blocked: []string{"1.2.3.4", "2001:db8::1"},
+			allowed: []string{"1.2.4.0", "2001:db9::1"},
+		},
+		{
+			name:    "gzip",
+			list:    gzipped("001.002.003.004 - 001.002.003.255 , 000 , dat\nold:5.6.7.8-5.6.7.8\n9.0.0.0/8\n"),
+			blocked: []string{"1.2.3.4", "5.6.7.8", "9.9.9.9"},
+			allowed: []string{"1.2.3.3", "8.8.8.8"},
+		},
+		{
+			name:    "comments",
+			list:    "# a comment\n\n   \n  # indented 1.2.3.4-1.2.3.5\n1.2.3.0/24\n",
+			blocked: []string{"1.2.3.4"},
+			allowed: []string{"5.6.7.8"},
+		},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			v4, v6, err := parseBlocklist(strings.NewReader(c.list))
+			if err != nil {
+				t.Fatal(err)
+			}
+			b := &blocklist{v4: v4, v6: v6}
+			for _, ip := range c.blocked {
+				if _, ok := b.Lookup(net.ParseIP(ip)); !ok {
+					t.Errorf("expected %s to be blocked", ip)
+				}
+			}
+			for _, ip := range c.allowed {
+				if _, ok := b.Lookup(net.ParseIP(ip)); ok {
+					t.Errorf("expected %s to be allowed", ip)
+				}
+			}
+		})
+	}
+	for _, list := range []string{
+		"001.002.003.004 - 001.002.003 , 000 , short\n",
+		"001.002.003.004 - 001.002.003.256 , 000 , overflow\n",
+		"001.002.003.004 - 001.002.003.255 , high , level\n",
+		"no colon 1.2.3.4-1.2.3.5\n",
+	} {
+		if _, _, err := parseBlocklist(strings.NewReader(list)); err == nil {
+			t.Errorf("expected an error parsing %q", list)
+		}
+	}
+}
@@ -0,0 +1,167 @@
+package engine
+
+import (
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// bulk actions
+const (
+	BulkStart      = "start"
+	BulkStop       = "stop"
+	BulkDelete     = "delete"
+	BulkDeleteData = "deletedata"
+	BulkRelabel    = "relabel"
+	BulkLimit      = "limit"
+	BulkRecheck    = "recheck"
+)
+
+// BulkRequest applies one action to many torrents, selected
+// by infohash or by filter (label, state and name pattern)
+type BulkRequest struct {
+	Action     string
+	InfoHashes []string
+	//filter
+	Label string
+	State string
+	Name  string
+	//restrict to the torrents of a user
+	Owner string
+	//relabel
+	Labels []string
+	//limit
+	MaxConns int
+}
+
+// BulkResult is the outcome of a bulk action on one torrent
+type BulkResult struct {
+	InfoHash string
+	Name     string
+	Error    string
+}
+
+// Bulk runs the request against all matching torrents while
+// holding the engine lock, so no other action interleaves
+// (the actions each take the lock, bulk uses their internals)
+func (e *Engine) Bulk(r BulkRequest) ([]BulkResult, error) {
+	var do func(infohash string) error
+	switch r.Action {
+	case BulkStart:
+		do = e.startTorrent
+	case BulkStop:
+		do = e.stopTorrent
+	case BulkDelete:
+		do = e.deleteTorrent
+	case BulkDeleteData:
+		do = e.deleteTorrentData
+	case BulkRecheck:
+		do = e.recheckTorrent
+	case BulkRelabel:
+		do = func(ih string) error { return e.setLabels(ih, r.Labels) }
+	case BulkLimit:
+		if r.MaxConns < 0 {
+			return nil, fmt.Errorf("Invalid max connections (%d)", r.MaxConns)
+		}
+		do = func(ih string) error { return e.setMaxConns(ih, r.MaxConns) }
+	default:
+		return nil, fmt.Errorf("Invalid bulk action: %s", r.Action)
+	}
+	if len(r.InfoHashes) == 0 && r.Label == "" && r.State == "" && r.Name == "" {
+		return nil, fmt.Errorf("Missing infohashes or filter")
+	}
+	switch r.State {
+	case "", "started", "stopped", "loading", "complete", "incomplete", "private":
+	default:
+		return nil, fmt.Errorf("Invalid state filter: %s", r.State)
+	}
+	if _, err := filepath.Match(r.Name, ""); err != nil {
+		return nil, fmt.Errorf("Invalid name pattern: %s", err)
+	}
+	e.mut.Lock()
+	defer e.mut.Unlock()
+	if e.client == nil {
+		return nil, fmt.Errorf("Engine not configured")
+	}
+	hashes := r.InfoHashes
+	if len(hashes) == 0 {
+		for ih := range e.ts {
+			hashes = append(hashes, ih)
+		}
+		sort.Strings(hashes)
+	}
+	results := []BulkResult{}
+	for _, ih := range hashes {
+		t, err := e.getTorrent(ih)
+		if err != nil {
+			results = append(results, BulkResult{InfoHash: ih, Error: err.Error()})
+			continue
+		}
+		if r.Owner != "" && t.Owner != r.Owner {
+			//other users' torrents don't exist
+			if len(r.InfoHashes) > 0 {
+				results = append(results, BulkResult{InfoHash: ih, Error: "Missing torrent " + ih})
+			}
+			continue
+		}
+		if !r.match(t) {
+			continue
+		}
+		res := BulkResult{InfoHash: t.InfoHash, Name: t.Name}
+		if err := do(t.InfoHash); err != nil {
+			res.Error = err.Error()
+		}
+		results = append(results, res)
+	}
+	return results, nil
+}
+
+func (r *BulkRequest) match(t *Torrent) bool {
+	if r.Label != "" {
+		found := false
+		for _, l := range t.Labels {
+			if l == r.Label {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	switch r.State {
+	case "started":
+		if !t.Started {
+			return false
+		}
+	case "stopped":
+		if t.Started {
+			return false
+		}
+	case "loading":
+		if t.Loaded {
+			return false
+		}
+	case "complete":
+		if !t.Loaded || t.Percent < 100 {
+			return false
+		}
+	case "incomplete":
+		if t.Loaded && t.Percent >= 100 {
+			return false
+		}
+	case "private":
+		if !t.Private {
+			return false
+		}
+	}
+	if r.Name != "" {
+		//case insensitive glob
+		ok, _ := filepath.Match(strings.ToLower(r.Name), strings.ToLower(t.Name))
+		if !ok {
+			return false
+		}
+	}
+	return true
+}
@@ -1,10 +1,39 @@
 package engine
 
+import "net/url"
+
 type Config struct {
-	AutoStart         bool
-	DisableEncryption bool
-	DownloadDirectory string
-	EnableUpload      bool
-	EnableSeeding     bool
-	IncomingPort      int
+	AutoStart          bool
+	DisableEncryption  bool
+	DownloadDirectory  string
+	EnableUpload       bool
+	EnableSeeding      bool
+	IncomingPort       int
+	Storage            string
+	Blocklist          string
+	Proxy              string
+	ListenAddress      string
+	Interface          string
+	DisableIPv4        bool
+	DisableIPv6        bool
+	KillSwitch         bool
+	MaxConnsPerTorrent int
+	MaxHalfOpenConns   int
+	DisableDHT         bool
+	DisablePEX         bool
+	DisableUTP         bool
+	DisableTCP         bool
+	EnableLSD          bool
+	PrivateMagnets     bool
+	DisableWebSeeds    bool
+	MergeDuplicates    bool
+}
+
+// Redacted is the config without the proxy password,
+// for users who may read but not change it
+func (c Config) Redacted() Config {
+	if u, err := url.Parse(c.Proxy); err == nil && u.User != nil {
+		c.Proxy = u.Redacted()
+	}
+	return c
 }
@@ -3,22 +3,41 @@ package engine
 import (
 	"encoding/hex"
 	"fmt"
+	"net"
+	"net/http"
+	"net/url"
 	"os"
 	"path/filepath"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/anacrolix/dht/v2"
 	"github.com/anacrolix/torrent"
+	"github.com/anacrolix/torrent/dialer"
 	"github.com/anacrolix/torrent/metainfo"
+	"github.com/anacrolix/torrent/storage"
+	"golang.org/x/net/proxy"
 )
 
 // the Engine Cloud Torrent engine, backed by anacrolix/torrent
 type Engine struct {
-	mut      sync.Mutex
-	cacheDir string
-	client   *torrent.Client
-	config   Config
-	ts       map[string]*Torrent
+	mut       sync.Mutex
+	cacheDir  string
+	client    *torrent.Client
+	storage   storage.ClientImplCloser
+	blocklist *blocklist
+	transport http.RoundTripper
+	done      chan struct{}
+	stopOnce  *sync.Once
+	prepared  *prepared
+	//kill switch engaged, read without the lock by the
+	//dials and requests it gates
+	killed    atomic.Bool
+	private   privateSet
+	savePaths savePaths
+	config    Config
+	ts        map[string]*Torrent
 }
 
 func New() *Engine {
@@ -29,14 +48,101 @@ func (e *Engine) Config() Config {
 	return e.config
 }
 
+// Configure validates c, then restarts the client with it.
+// when the new client fails to start, the previous config
+// is restored.
 func (e *Engine) Configure(c Config) error {
 	//recieve config
-	if e.client != nil {
-		e.client.Close()
-		time.Sleep(1 * time.Second)
+	next, err := prepare(c)
+	if err != nil {
+		return err
 	}
+	prev := e.prepared
+	e.stop()
+	if err := e.start(next); err != nil {
+		if prev != nil {
+			if rerr := e.start(prev); rerr != nil {
+				return fmt.Errorf("%s (restoring previous config failed: %s)", err, rerr)
+			}
+		}
+		return err
+	}
+	return nil
+}
+
+// prepared is a validated config, ready to start a client
+type prepared struct {
+	c           Config
+	bind        bindHosts
+	proxyURL    *url.URL
+	proxyDialer proxy.ContextDialer
+	transport   http.RoundTripper
+	blocklist   *blocklist
+}
+
+// prepare validates c, loading everything which
+// doesn't conflict with the running client
+func prepare(c Config) (*prepared, error) {
 	if c.IncomingPort <= 0 {
-		return fmt.Errorf("Invalid incoming port (%d)", c.IncomingPort)
+		return nil, fmt.Errorf("Invalid incoming port (%d)", c.IncomingPort)
+	}
+	if c.Storage == "" {
+		c.Storage = StorageFile
+	}
+	if c.MaxConnsPerTorrent < 0 {
+		return nil, fmt.Errorf("Invalid max connections per torrent (%d)", c.MaxConnsPerTorrent)
+	}
+	if c.MaxHalfOpenConns < 0 {
+		return nil, fmt.Errorf("Invalid max half-open connections (%d)", c.MaxHalfOpenConns)
+	}
+	if c.DisableTCP && (c.DisableUTP || c.Proxy != "") {
+		return nil, fmt.Errorf("Either TCP or uTP must be enabled (uTP is unavailable via proxy)")
+	}
+	bind, err := resolveBind(c)
+	if err != nil {
+		return nil, err
+	}
+	p := &prepared{c: c, bind: bind, transport: http.DefaultTransport}
+	if c.Proxy != "" {
+		u, d, err := newProxy(c.Proxy)
+		if err != nil {
+			return nil, err
+		}
+		p.proxyURL = u
+		p.proxyDialer = d
+		p.transport = newProxyTransport(u)
+	}
+	p.blocklist = &blocklist{transport: p.transport}
+	if c.Blocklist != "" {
+		if err := p.blocklist.load(c.Blocklist); err != nil {
+			return nil, fmt.Errorf("Invalid blocklist: %s", err)
+		}
+	}
+	return p, nil
+}
+
+// stop closes the running client, once
+func (e *Engine) stop() {
+	e.mut.Lock()
+	once := e.stopOnce
+	e.mut.Unlock()
+	if once == nil {
+		return
+	}
+	once.Do(func() {
+		e.client.Close()
+		e.storage.Close()
+		close(e.done)
+		time.Sleep(1 * time.Second)
+	})
+}
+
+// start a client with the prepared config
+func (e *Engine) start(p *prepared) error {
+	c, bind, bl := p.c, p.bind, p.blocklist
+	store, err := newStorage(c, e.savePaths.torrentDir)
+	if err != nil {
+		return err
 	}
 
 	config := torrent.NewDefaultClientConfig()
@@ -44,42 +150,112 @@ func (e *Engine) Configure(c Config) error {
 	config.NoUpload = !c.EnableUpload
 	config.Seed = c.EnableSeeding
 	config.ListenPort = c.IncomingPort
+	config.DefaultStorage = store
+	config.IPBlocklist = bl
+	//dht announces are handled by the engine to skip private torrents
+	config.PeriodicallyAnnounceTorrentsToDht = false
+	e.privateCallbacks(&config.Callbacks)
+	config.NoDHT = c.DisableDHT
+	config.DisablePEX = c.DisablePEX
+	config.DisableUTP = c.DisableUTP
+	config.DisableTCP = c.DisableTCP
+	config.DisableWebseeds = c.DisableWebSeeds
+	if c.MaxConnsPerTorrent > 0 {
+		config.EstablishedConnsPerTorrent = c.MaxConnsPerTorrent
+	}
+	if c.MaxHalfOpenConns > 0 {
+		config.TotalHalfOpenConns = c.MaxHalfOpenConns
+		if config.HalfOpenConnsPerTorrent > c.MaxHalfOpenConns {
+			config.HalfOpenConnsPerTorrent = c.MaxHalfOpenConns
+		}
+	}
+	config.DisableIPv4 = c.DisableIPv4
+	config.DisableIPv6 = c.DisableIPv6
+	if bind.bound {
+		config.ListenHost = bind.listenHost
+		config.DisableIPv4 = bind.v4 == ""
+		config.DisableIPv6 = bind.v6 == ""
+	}
+	//trackers, web seeds and metainfo sources fail closed
+	//while the kill switch is engaged
+	config.TrackerDialContext = e.killSwitchDial
+	config.TrackerListenPacket = e.killSwitchListenPacket
+	config.WebTransport = e.killSwitchTransport(&http.Transport{MaxConnsPerHost: 10})
+	if p.proxyURL != nil {
+		config.HTTPProxy = http.ProxyURL(p.proxyURL)
+		config.WebTransport = e.killSwitchTransport(p.transport)
+		config.DialForPeerConns = false
+		config.DisableUTP = true
+		config.NoDHT = true
+		config.TrackerListenPacket = func(network, addr string) (net.PacketConn, error) {
+			return nil, errUDPProxy
+		}
+	}
 	client, err := torrent.NewClient(config)
 	if err != nil {
+		store.Close()
 		return err
 	}
+	if p.proxyDialer != nil {
+		client.AddDialer(dialer.WithNetwork{Network: "tcp", Dialer: p.proxyDialer})
+	}
+	done := make(chan struct{})
 	e.mut.Lock()
 	e.config = c
+	e.prepared = p
 	e.client = client
+	e.storage = store
+	e.blocklist = bl
+	e.transport = p.transport
+	e.done = done
+	e.stopOnce = &sync.Once{}
+	e.killed.Store(false)
 	e.mut.Unlock()
+	if c.Blocklist != "" {
+		bl.transport = e.killSwitchTransport(p.transport)
+		go bl.watch(c.Blocklist, done)
+	}
+	if !config.NoDHT {
+		go e.announceDHT(done)
+	}
+	if c.EnableLSD && p.proxyURL == nil {
+		go e.runLSD(client.LocalPort(), done)
+	}
+	if c.KillSwitch && bind.bound {
+		go e.watchBind(c, bind, done)
+	}
 	//reset
 	e.GetTorrents()
 	return nil
 }
 
-func (e *Engine) NewMagnet(magnetURI string) error {
-	tt, err := e.client.AddMagnet(magnetURI)
-	if err != nil {
-		return err
-	}
-	return e.newTorrent(tt)
+// Stats of the engine as a whole
+type Stats struct {
+	BlocklistRanges   int
+	BlocklistRejected int64
+	KillSwitch        bool
+	DHTNodes          int
+	DHTGoodNodes      int
 }
 
-func (e *Engine) NewTorrent(spec *torrent.TorrentSpec) error {
-	tt, _, err := e.client.AddTorrentSpec(spec)
-	if err != nil {
-		return err
+func (e *Engine) Stats() Stats {
+	e.mut.Lock()
+	defer e.mut.Unlock()
+	s := Stats{}
+	if e.blocklist != nil {
+		s.BlocklistRanges = e.blocklist.NumRanges()
+		s.BlocklistRejected = e.blocklist.Rejected()
 	}
-	return e.newTorrent(tt)
-}
-
-func (e *Engine) newTorrent(tt *torrent.Torrent) error {
-	t := e.upsertTorrent(tt)
-	go func() {
-		<-t.t.GotInfo()
-		e.StartTorrent(t.InfoHash)
-	}()
-	return nil
+	s.KillSwitch = e.killed.Load()
+	if e.client != nil {
+		for _, d := range e.client.DhtServers() {
+			if ds, ok := d.Stats().(dht.ServerStats); ok {
+				s.DHTNodes += ds.Nodes
+				s.DHTGoodNodes += ds.GoodNodes
+			}
+		}
+	}
+	return s
 }
 
 // GetTorrents moves torrents out of the anacrolix/torrent
@@ -97,6 +273,14 @@ func (e *Engine) GetTorrents() map[string]*Torrent {
 	return e.ts
 }
 
+// CopyTorrent copies t under the engine lock, so the
+// copy may be read while the engine updates t
+func (e *Engine) CopyTorrent(t *Torrent) *Torrent {
+	e.mut.Lock()
+	defer e.mut.Unlock()
+	return t.copy()
+}
+
 func (e *Engine) upsertTorrent(tt *torrent.Torrent) *Torrent {
 	ih := tt.InfoHash().HexString()
 	torrent, ok := e.ts[ih]
@@ -106,6 +290,7 @@ func (e *Engine) upsertTorrent(tt *torrent.Torrent) *Torrent {
 	}
 	//update torrent fields using underlying torrent
 	torrent.Update(tt)
+	e.private.set(tt.InfoHash(), torrent.Private)
 	return torrent
 }
 
@@ -130,6 +315,12 @@ func (e *Engine) getOpenTorrent(infohash string) (*Torrent, error) {
 }
 
 func (e *Engine) StartTorrent(infohash string) error {
+	e.mut.Lock()
+	defer e.mut.Unlock()
+	return e.startTorrent(infohash)
+}
+
+func (e *Engine) startTorrent(infohash string) error {
 	t, err := e.getOpenTorrent(infohash)
 	if err != nil {
 		return err
@@ -137,19 +328,28 @@ func (e *Engine) StartTorrent(infohash string) error {
 	if t.Started {
 		return fmt.Errorf("Already started")
 	}
+	if e.killed.Load() {
+		return errKilled
+	}
 	t.Started = true
 	for _, f := range t.Files {
 		if f != nil {
-			f.Started = true
+			f.Started = t.selected == nil || t.selected[f.Path]
 		}
 	}
 	if t.t.Info() != nil {
-		t.t.DownloadAll()
+		t.download()
 	}
 	return nil
 }
 
 func (e *Engine) StopTorrent(infohash string) error {
+	e.mut.Lock()
+	defer e.mut.Unlock()
+	return e.stopTorrent(infohash)
+}
+
+func (e *Engine) stopTorrent(infohash string) error {
 	t, err := e.getTorrent(infohash)
 	if err != nil {
 		return err
@@ -169,6 +369,12 @@ func (e *Engine) StopTorrent(infohash string) error {
 }
 
 func (e *Engine) DeleteTorrent(infohash string) error {
+	e.mut.Lock()
+	defer e.mut.Unlock()
+	return e.deleteTorrent(infohash)
+}
+
+func (e *Engine) deleteTorrent(infohash string) error {
 	t, err := e.getTorrent(infohash)
 	if err != nil {
 		return err
@@ -182,7 +388,105 @@ func (e *Engine) DeleteTorrent(infohash string) error {
 	return nil
 }
 
+// DeleteTorrentData deletes the torrent along with its
+// downloaded files (file and mmap storage only)
+func (e *Engine) DeleteTorrentData(infohash string) error {
+	e.mut.Lock()
+	defer e.mut.Unlock()
+	return e.deleteTorrentData(infohash)
+}
+
+func (e *Engine) deleteTorrentData(infohash string) error {
+	t, err := e.getTorrent(infohash)
+	if err != nil {
+		return err
+	}
+	if e.config.Storage != StorageFile && e.config.Storage != StorageMMap {
+		return fmt.Errorf("Deleting data requires file or mmap storage")
+	}
+	if !t.Loaded {
+		return e.deleteTorrent(infohash)
+	}
+	base := filepath.Join(e.config.DownloadDirectory, t.SavePath)
+	if !filepath.IsLocal(t.Name) {
+		return fmt.Errorf("Invalid torrent name (%s)", t.Name)
+	}
+	if err := e.deleteTorrent(infohash); err != nil {
+		return err
+	}
+	return os.RemoveAll(filepath.Join(base, t.Name))
+}
+
+// SetLabels replaces the labels of a torrent
+func (e *Engine) SetLabels(infohash string, labels []string) error {
+	e.mut.Lock()
+	defer e.mut.Unlock()
+	return e.setLabels(infohash, labels)
+}
+
+func (e *Engine) setLabels(infohash string, labels []string) error {
+	t, err := e.getTorrent(infohash)
+	if err != nil {
+		return err
+	}
+	t.Labels = labels
+	return nil
+}
+
+// SetMaxConns limits the established peer connections
+// of a torrent, zero restores the default
+func (e *Engine) SetMaxConns(infohash string, max int) error {
+	e.mut.Lock()
+	defer e.mut.Unlock()
+	return e.setMaxConns(infohash, max)
+}
+
+func (e *Engine) setMaxConns(infohash string, max int) error {
+	t, err := e.getTorrent(infohash)
+	if err != nil {
+		return err
+	}
+	if max < 0 {
+		return fmt.Errorf("Invalid max connections (%d)", max)
+	}
+	t.MaxConns = max
+	if max == 0 {
+		max = torrent.NewDefaultClientConfig().EstablishedConnsPerTorrent
+		if e.config.MaxConnsPerTorrent > 0 {
+			max = e.config.MaxConnsPerTorrent
+		}
+	}
+	if t.pausedConns > 0 {
+		t.pausedConns = max
+	} else {
+		t.t.SetMaxEstablishedConns(max)
+	}
+	return nil
+}
+
+// RecheckTorrent verifies the downloaded data of a
+// torrent in the background
+func (e *Engine) RecheckTorrent(infohash string) error {
+	e.mut.Lock()
+	defer e.mut.Unlock()
+	return e.recheckTorrent(infohash)
+}
+
+func (e *Engine) recheckTorrent(infohash string) error {
+	t, err := e.getTorrent(infohash)
+	if err != nil {
+		return err
+	}
+	if !t.Loaded {
+		return fmt.Errorf("Torrent info not loaded")
+	}
+	go t.t.VerifyData()
+	return nil
+}
+
 func (e *Engine) StartFile(infohash, filepath string) error {
+	e.mut.Lock()
+	defer e.mut.Unlock()
 	t, err := e.getOpenTorrent(infohash)
 	if err != nil {
 		return err
@@ -205,6 +509,36 @@ func (e *Engine) StartFile(infohash, filepath string) error {
 	return nil
 }
 
+// AddWebSeeds adds BEP 19 web seed urls to a torrent,
+// which are used alongside its swarm peers
+func (e *Engine) AddWebSeeds(infohash string, urls []string) error {
+	e.mut.Lock()
+	defer e.mut.Unlock()
+	t, err := e.getTorrent(infohash)
+	if err != nil {
+		return err
+	}
+	for _, u := range urls {
+		if err := validWebSeed(u); err != nil {
+			return err
+		}
+	}
+	if e.config.DisableWebSeeds {
+		return fmt.Errorf("Web seeds are disabled")
+	}
+	t.t.AddWebSeeds(urls)
+	t.addWebSeeds(urls)
+	return nil
+}
+
+func validWebSeed(s string) error {
+	u, err := url.Parse(s)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("Invalid web seed URL: %s", s)
+	}
+	return nil
+}
+
 func (e *Engine) StopFile(infohash, filepath string) error {
 	return fmt.Errorf("Unsupported")
 }
@@ -0,0 +1,145 @@
+package engine
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func freePort(t *testing.T) (int, net.Listener) {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return l.Addr().(*net.TCPAddr).Port, l
+}
+
+func testConfig(t *testing.T, port int) Config {
+	return Config{
+		DownloadDirectory: t.TempDir(),
+		IncomingPort:      port,
+		ListenAddress:     "127.0.0.1",
+		DisableDHT:        true,
+		DisableUTP:        true,
+	}
+}
+
+func TestConfigureInvalidKeepsClient(t *testing.T) {
+	port, l := freePort(t)
+	l.Close()
+	e := New()
+	if err := e.Configure(testConfig(t, port)); err != nil {
+		t.Fatal(err)
+	}
+	defer e.stop()
+	bad := testConfig(t, port)
+	bad.MaxConnsPerTorrent = -1
+	if err := e.Configure(bad); err == nil {
+		t.Fatal("expected invalid config error")
+	}
+	if e.Config().MaxConnsPerTorrent != 0 {
+		t.Fatal("invalid config was applied")
+	}
+	//used to panic closing the done channel twice
+	if err := e.Configure(testConfig(t, port)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestConfigureRestoresPrevious(t *testing.T) {
+	port, l := freePort(t)
+	l.Close()
+	e := New()
+	if err := e.Configure(testConfig(t, port)); err != nil {
+		t.Fatal(err)
+	}
+	defer e.stop()
+	//the new client can't listen on a port in use
+	busy, l := freePort(t)
+	defer l.Close()
+	if err := e.Configure(testConfig(t, busy)); err == nil {
+		t.Fatal("expected listen error")
+	}
+	if got := e.Config().IncomingPort; got != port {
+		t.Fatalf("expected previous port %d, got %d", port, got)
+	}
+	if e.GetTorrents() == nil {
+		t.Fatal("expected a running client")
+	}
+	if err := e.Configure(testConfig(t, port)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCopyTorrentConcurrent(t *testing.T) {
+	e := testEngine(t)
+	tr, err := e.AddMagnet(testMagnet, AddOptions{Paused: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 200; i++ {
+			e.GetTorrents()
+			e.SetLabels(tr.InfoHash, []string{fmt.Sprint(i)})
+			e.AddWebSeeds(tr.InfoHash, []string{fmt.Sprintf("http://seed.example/%d/", i)})
+		}
+	}()
+	//run with -race, copies are taken while the engine updates
+	for copying := true; copying; {
+		select {
+		case <-done:
+			copying = false
+		default:
+		}
+		c := e.CopyTorrent(tr)
+		_ = fmt.Sprint(c.Name, c.Labels, c.WebSeeds, c.Files)
+	}
+	if c := e.CopyTorrent(tr); len(c.Labels) != 1 || c.Labels[0] != "199" {
+		t.Fatalf("expected the last labels, got %v", c.Labels)
+	}
+}
+
+func TestKillSwitchTrackers(t *testing.T) {
+	e := testEngine(t)
+	announced := make(chan string, 10)
+	tracker := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		announced <- fmt.Sprintf("%x", r.URL.Query().Get("info_hash"))
+		w.Write([]byte("d8:intervali1800e5:peers0:e"))
+	}))
+	defer tracker.Close()
+	add := func(ih string) {
+		t.Helper()
+		if _, err := e.AddMagnet("magnet:?xt=urn:btih:"+ih+"&tr="+url.QueryEscape(tracker.URL+"/announce"), AddOptions{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	//nothing goes out while the kill switch is engaged
+	e.killed.Store(true)
+	add("c12fe1c06bba254a9dc9f519b335aa7c1367a88a")
+	if _, err := e.Transport().RoundTrip(httptest.NewRequest("GET", tracker.URL, nil)); err != errKilled {
+		t.Fatalf("expected the engine transport to fail, got %v", err)
+	}
+	select {
+	case ih := <-announced:
+		t.Fatalf("expected no announces, got %s", ih)
+	case <-time.After(2 * time.Second):
+	}
+	//and trackers are announced to once it's released
+	e.killed.Store(false)
+	add("d12fe1c06bba254a9dc9f519b335aa7c1367a88a")
+	select {
+	case ih := <-announced:
+		if ih != "d12fe1c06bba254a9dc9f519b335aa7c1367a88a" {
+			t.Fatalf("expected an announce of the second torrent, got %s", ih)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("expected an announce")
+	}
+}
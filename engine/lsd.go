@@ -0,0 +1,125 @@
+package engine
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/anacrolix/torrent"
+)
+
+// local service discovery (BEP 14), multicasts the
+// torrents we have to peers on the local network
+const (
+	lsdAddr     = "239.192.152.143:6771"
+	lsdInterval = 5 * time.Minute
+	//keep announcements under the typical mtu
+	lsdMaxInfohashes = 20
+)
+
+func (e *Engine) runLSD(port int, done chan struct{}) {
+	group, err := net.ResolveUDPAddr("udp4", lsdAddr)
+	if err != nil {
+		log.Printf("LSD disabled: %s", err)
+		return
+	}
+	conn, err := net.ListenMulticastUDP("udp4", nil, group)
+	if err != nil {
+		log.Printf("LSD disabled: %s", err)
+		return
+	}
+	b := make([]byte, 8)
+	rand.Read(b)
+	cookie := hex.EncodeToString(b)
+	go func() {
+		<-done
+		conn.Close()
+	}()
+	go e.announceLSD(conn, group, port, cookie, done)
+	buff := make([]byte, 1500)
+	for {
+		n, src, err := conn.ReadFromUDP(buff)
+		if err != nil {
+			return
+		}
+		e.receiveLSD(buff[:n], src, cookie)
+	}
+}
+
+func (e *Engine) announceLSD(conn *net.UDPConn, group *net.UDPAddr, port int, cookie string, done chan struct{}) {
+	for {
+		var ihs []string
+		e.mut.Lock()
+		for _, tt := range e.client.Torrents() {
+			if e.private.has(tt.InfoHash()) {
+				continue
+			}
+			ihs = append(ihs, tt.InfoHash().HexString())
+		}
+		e.mut.Unlock()
+		for len(ihs) > 0 {
+			n := len(ihs)
+			if n > lsdMaxInfohashes {
+				n = lsdMaxInfohashes
+			}
+			msg := &bytes.Buffer{}
+			fmt.Fprintf(msg, "BT-SEARCH * HTTP/1.1\r\nHost: %s\r\nPort: %d\r\n", lsdAddr, port)
+			for _, ih := range ihs[:n] {
+				fmt.Fprintf(msg, "Infohash: %s\r\n", ih)
+			}
+			fmt.Fprintf(msg, "cookie: %s\r\n\r\n\r\n", cookie)
+			conn.WriteToUDP(msg.Bytes(), group)
+			ihs = ihs[n:]
+		}
+		select {
+		case <-done:
+			return
+		case <-time.After(lsdInterval):
+		}
+	}
+}
+
+func (e *Engine) receiveLSD(b []byte, src *net.UDPAddr, cookie string) {
+	r := bufio.NewReader(bytes.NewReader(b))
+	line, err := r.ReadString('\n')
+	if err != nil || !strings.HasPrefix(line, "BT-SEARCH * HTTP/1.1") {
+		return
+	}
+	req, err := http.ReadRequest(bufio.NewReader(bytes.NewReader(append([]byte("GET / HTTP/1.1\r\n"), b[len(line):]...))))
+	if err != nil {
+		return
+	}
+	if req.Header.Get("cookie") == cookie {
+		return //our own announce
+	}
+	port, err := strconv.Atoi(req.Header.Get("Port"))
+	if err != nil || port <= 0 || port > 65535 {
+		return
+	}
+	peer := torrent.PeerInfo{
+		Addr:   &net.TCPAddr{IP: src.IP, Port: port},
+		Source: torrent.PeerSourceDirect,
+	}
+	e.mut.Lock()
+	defer e.mut.Unlock()
+	for _, ih := range req.Header.Values("Infohash") {
+		hash, err := str2ih(strings.ToLower(strings.TrimSpace(ih)))
+		if err != nil {
+			continue
+		}
+		if e.private.has(hash) {
+			continue
+		}
+		if tt, ok := e.client.Torrent(hash); ok {
+			tt.AddPeers([]torrent.PeerInfo{peer})
+		}
+	}
+}
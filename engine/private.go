@@ -0,0 +1,131 @@
+package engine
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/anacrolix/torrent"
+	"github.com/anacrolix/torrent/metainfo"
+	pp "github.com/anacrolix/torrent/peer_protocol"
+)
+
+const (
+	//how often public torrents are announced to the DHT
+	dhtAnnounceInterval = 5 * time.Minute
+	//how long each announce may search for peers
+	dhtAnnounceTimeout = 2 * time.Minute
+)
+
+// privateSet holds the infohashes of torrents which must only
+// find peers via their trackers (BEP 27). it has its own lock
+// since it's read from anacrolix callbacks.
+type privateSet struct {
+	mut sync.RWMutex
+	ihs map[metainfo.Hash]bool
+}
+
+func (p *privateSet) set(ih metainfo.Hash, private bool) {
+	p.mut.Lock()
+	if p.ihs == nil {
+		p.ihs = map[metainfo.Hash]bool{}
+	}
+	if private {
+		p.ihs[ih] = true
+	} else {
+		delete(p.ihs, ih)
+	}
+	p.mut.Unlock()
+}
+
+func (p *privateSet) has(ih metainfo.Hash) bool {
+	p.mut.RLock()
+	defer p.mut.RUnlock()
+	return p.ihs[ih]
+}
+
+// privateCallbacks stop connections of private
+// torrents from advertising or accepting PEX
+func (e *Engine) privateCallbacks(callbacks *torrent.Callbacks) {
+	callbacks.PeerConnAdded = append(callbacks.PeerConnAdded, func(pc *torrent.PeerConn) {
+		if !e.private.has(pc.Torrent().InfoHash()) {
+			return
+		}
+		m := &torrent.LocalLtepProtocolMap{}
+		for i, name := range pc.LocalLtepProtocolMap.Index {
+			if name == pp.ExtensionNamePex {
+				continue
+			}
+			m.Index = append(m.Index, name)
+			if i < pc.LocalLtepProtocolMap.NumBuiltin {
+				m.NumBuiltin++
+			}
+		}
+		pc.LocalLtepProtocolMap = m
+	})
+	callbacks.ReadExtendedHandshake = func(pc *torrent.PeerConn, msg *pp.ExtendedHandshakeMessage) {
+		if e.private.has(pc.Torrent().InfoHash()) {
+			delete(msg.M, pp.ExtensionNamePex)
+		}
+	}
+}
+
+// announceDHT replaces anacrolix's own DHT announcer,
+// only announcing torrents which aren't private
+func (e *Engine) announceDHT(done chan struct{}) {
+	for {
+		e.mut.Lock()
+		var tts []*torrent.Torrent
+		//nothing is announced while the kill switch is engaged
+		for _, t := range e.ts {
+			if t.t != nil && !t.Private && (t.Started || !t.Loaded) && !e.killed.Load() {
+				tts = append(tts, t.t)
+			}
+		}
+		servers := e.client.DhtServers()
+		e.mut.Unlock()
+		for _, tt := range tts {
+			announceTorrent(tt, servers, done)
+		}
+		select {
+		case <-done:
+			return
+		case <-time.After(dhtAnnounceInterval):
+		}
+	}
+}
+
+func announceTorrent(tt *torrent.Torrent, servers []torrent.DhtServer, done chan struct{}) {
+	for _, s := range servers {
+		annDone, stop, err := tt.AnnounceToDht(s)
+		if err != nil {
+			continue
+		}
+		go func() {
+			select {
+			case <-annDone:
+			case <-done:
+			case <-time.After(dhtAnnounceTimeout):
+			}
+			stop()
+		}()
+	}
+}
+
+// SetPrivate forces a torrent into private mode, or back out of it
+// when its metainfo isn't marked private
+func (e *Engine) SetPrivate(infohash string, private bool) error {
+	e.mut.Lock()
+	defer e.mut.Unlock()
+	t, err := e.getTorrent(infohash)
+	if err != nil {
+		return err
+	}
+	t.forcePrivate = private
+	t.updatePrivate()
+	if !private && t.Private {
+		return fmt.Errorf("Torrent metainfo is marked private")
+	}
+	e.private.set(t.t.InfoHash(), t.Private)
+	return nil
+}
@@ -0,0 +1,136 @@
+package engine
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"golang.org/x/net/proxy"
+)
+
+// newProxy parses a socks5:// or http:// proxy url and returns
+// a dialer which connects through it. when a proxy is set, peer
+// connections are dialed via the proxy and udp traffic (uTP, DHT
+// and udp trackers) is disabled since it cannot be proxied.
+func newProxy(proxyURL string) (*url.URL, proxy.ContextDialer, error) {
+	u, err := url.Parse(proxyURL)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Invalid proxy url: %s", err)
+	}
+	if u.Host == "" {
+		return nil, nil, fmt.Errorf("Invalid proxy url: missing host")
+	}
+	switch u.Scheme {
+	case "socks5", "socks5h":
+		d, err := proxy.FromURL(u, proxy.Direct)
+		if err != nil {
+			return nil, nil, fmt.Errorf("Invalid proxy url: %s", err)
+		}
+		cd, ok := d.(proxy.ContextDialer)
+		if !ok {
+			return nil, nil, fmt.Errorf("Invalid proxy url: no context dialer")
+		}
+		return u, cd, nil
+	case "http", "https":
+		return u, &connectDialer{proxy: u}, nil
+	}
+	return nil, nil, fmt.Errorf("Invalid proxy scheme (%s)", u.Scheme)
+}
+
+// newProxyTransport returns an http transport using the proxy
+func newProxyTransport(u *url.URL) http.RoundTripper {
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.Proxy = http.ProxyURL(u)
+	return t
+}
+
+// Transport is an http.RoundTripper which follows the
+// proxy setting of the engine's current configuration
+// (and fails while the kill switch is engaged)
+func (e *Engine) Transport() http.RoundTripper {
+	return roundTripper(func(r *http.Request) (*http.Response, error) {
+		if e.killed.Load() {
+			return nil, errKilled
+		}
+		e.mut.Lock()
+		t := e.transport
+		e.mut.Unlock()
+		if t == nil {
+			t = http.DefaultTransport
+		}
+		return t.RoundTrip(r)
+	})
+}
+
+type roundTripper func(*http.Request) (*http.Response, error)
+
+func (fn roundTripper) RoundTrip(r *http.Request) (*http.Response, error) {
+	return fn(r)
+}
+
+// connectDialer tunnels tcp connections through
+// an http proxy using the CONNECT method
+type connectDialer struct {
+	proxy *url.URL
+}
+
+func (d *connectDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	var nd net.Dialer
+	conn, err := nd.DialContext(ctx, "tcp", d.proxy.Host)
+	if err != nil {
+		return nil, err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	req := &http.Request{
+		Method: "CONNECT",
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: http.Header{},
+	}
+	if u := d.proxy.User; u != nil {
+		pass, _ := u.Password()
+		auth := base64.StdEncoding.EncodeToString([]byte(u.Username() + ":" + pass))
+		req.Header.Set("Proxy-Authorization", "Basic "+auth)
+	}
+	if err := req.Write(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		conn.Close()
+		return nil, fmt.Errorf("Proxy CONNECT failed: %s", resp.Status)
+	}
+	conn.SetDeadline(time.Time{})
+	if br.Buffered() > 0 {
+		return &bufferedConn{Conn: conn, r: br}, nil
+	}
+	return conn, nil
+}
+
+// bufferedConn reads out any bytes the proxy sent
+// after its CONNECT response before the raw conn
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+var errUDPProxy = errors.New("udp trackers are disabled when using a proxy")
@@ -0,0 +1,220 @@
+package engine
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+)
+
+// socks5 is an in-process SOCKS5 proxy (RFC 1928, with
+// RFC 1929 password auth) which records its targets
+type socks5 struct {
+	net.Listener
+	user, pass string
+	mut        sync.Mutex
+	targets    []string
+}
+
+func newSOCKS5(t *testing.T, user, pass string) *socks5 {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &socks5{Listener: l, user: user, pass: pass}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+	return s
+}
+
+func (s *socks5) URL() string {
+	if s.user != "" {
+		return fmt.Sprintf("socks5://%s:%s@%s", s.user, s.pass, s.Addr())
+	}
+	return "socks5://" + s.Addr().String()
+}
+
+func (s *socks5) Targets() []string {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	return append([]string{}, s.targets...)
+}
+
+func (s *socks5) serve(conn net.Conn) {
+	defer conn.Close()
+	b := make([]byte, 256)
+	//greeting: ver, methods
+	if _, err := io.ReadFull(conn, b[:2]); err != nil || b[0] != 5 {
+		return
+	}
+	if _, err := io.ReadFull(conn, b[:b[1]]); err != nil {
+		return
+	}
+	if s.user == "" {
+		conn.Write([]byte{5, 0})
+	} else {
+		conn.Write([]byte{5, 2})
+		//ver, user, pass
+		if _, err := io.ReadFull(conn, b[:2]); err != nil {
+			return
+		}
+		user := make([]byte, b[1])
+		io.ReadFull(conn, user)
+		io.ReadFull(conn, b[:1])
+		pass := make([]byte, b[0])
+		io.ReadFull(conn, pass)
+		if string(user) != s.user || string(pass) != s.pass {
+			conn.Write([]byte{1, 1})
+			return
+		}
+		conn.Write([]byte{1, 0})
+	}
+	//request: ver, cmd, rsv, atyp, addr, port
+	if _, err := io.ReadFull(conn, b[:4]); err != nil || b[1] != 1 {
+		return
+	}
+	var host string
+	switch b[3] {
+	case 1, 4:
+		ip := make(net.IP, 4)
+		if b[3] == 4 {
+			ip = make(net.IP, 16)
+		}
+		io.ReadFull(conn, ip)
+		host = ip.String()
+	case 3:
+		io.ReadFull(conn, b[:1])
+		name := make([]byte, b[0])
+		io.ReadFull(conn, name)
+		host = string(name)
+	default:
+		return
+	}
+	io.ReadFull(conn, b[:2])
+	target := net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(b[:2]))))
+	s.mut.Lock()
+	s.targets = append(s.targets, target)
+	s.mut.Unlock()
+	up, err := net.Dial("tcp", target)
+	if err != nil {
+		conn.Write([]byte{5, 5, 0, 1, 0, 0, 0, 0, 0, 0})
+		return
+	}
+	defer up.Close()
+	conn.Write([]byte{5, 0, 0, 1, 0, 0, 0, 0, 0, 0})
+	go io.Copy(up, conn)
+	io.Copy(conn, up)
+}
+
+// echo serves one line back to each connection
+func echo(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+	return l.Addr().String()
+}
+
+func TestProxyDialer(t *testing.T) {
+	for _, creds := range [][2]string{{"", ""}, {"bob", "secret"}} {
+		proxy := newSOCKS5(t, creds[0], creds[1])
+		addr := echo(t)
+		_, d, err := newProxy(proxy.URL())
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn, err := d.DialContext(context.Background(), "tcp", addr)
+		if err != nil {
+			t.Fatalf("dial via proxy (user %q): %s", creds[0], err)
+		}
+		conn.Write([]byte("ping"))
+		b := make([]byte, 4)
+		if _, err := io.ReadFull(conn, b); err != nil || string(b) != "ping" {
+			t.Fatalf("expected echo, got %q %v", b, err)
+		}
+		conn.Close()
+		if got := proxy.Targets(); len(got) != 1 || got[0] != addr {
+			t.Fatalf("expected proxy target %s, got %v", addr, got)
+		}
+	}
+}
+
+func TestProxyDialerBadPassword(t *testing.T) {
+	proxy := newSOCKS5(t, "bob", "secret")
+	_, d, err := newProxy("socks5://bob:wrong@" + proxy.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.DialContext(context.Background(), "tcp", echo(t)); err == nil {
+		t.Fatal("expected auth failure")
+	}
+}
+
+func TestProxyConfig(t *testing.T) {
+	for _, u := range []string{"ftp://host:21", "socks5://", "http://"} {
+		if _, _, err := newProxy(u); err == nil {
+			t.Fatalf("expected %q to be rejected", u)
+		}
+	}
+}
+
+func TestEngineTransportProxy(t *testing.T) {
+	proxy := newSOCKS5(t, "", "")
+	web := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	defer web.Close()
+	port, l := freePort(t)
+	l.Close()
+	e := New()
+	c := testConfig(t, port)
+	c.Proxy = proxy.URL()
+	if err := e.Configure(c); err != nil {
+		t.Fatal(err)
+	}
+	defer e.stop()
+	client := &http.Client{Transport: e.Transport()}
+	resp, err := client.Get(web.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(b) != "ok" {
+		t.Fatalf("expected ok, got %q", b)
+	}
+	if got := proxy.Targets(); len(got) != 1 || got[0] != web.Listener.Addr().String() {
+		t.Fatalf("expected request via proxy, got targets %v", got)
+	}
+	//the default client is left alone
+	if http.DefaultClient.Transport != nil {
+		t.Fatal("default client was modified")
+	}
+}
@@ -0,0 +1,117 @@
+package engine
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/anacrolix/torrent"
+	"github.com/anacrolix/torrent/metainfo"
+	"github.com/anacrolix/torrent/storage"
+)
+
+// piece storage backends, selected with Config.Storage.
+// file and mmap write regular files into the download directory,
+// sqlite and bolt keep all piece data inside a single database
+// file, so there is nothing to browse on disk.
+const (
+	StorageFile   = "file"
+	StorageMMap   = "mmap"
+	StorageSQLite = "sqlite"
+	StorageBolt   = "bolt"
+)
+
+// database backends live in a hidden directory so
+// they're skipped by the download listing
+const storageDir = ".storage"
+
+// FileStorage reports whether torrent data is stored as
+// regular files inside the download directory
+func (c Config) FileStorage() bool {
+	return c.Storage == "" || c.Storage == StorageFile || c.Storage == StorageMMap
+}
+
+// mmapDirs is mmap storage which, like file storage,
+// keeps each torrent inside its save path
+type mmapDirs struct {
+	baseDir    string
+	dirMaker   storage.TorrentDirFilePathMaker
+	completion storage.PieceCompletion
+}
+
+func (m *mmapDirs) OpenTorrent(ctx context.Context, info *metainfo.Info, ih metainfo.Hash) (storage.TorrentImpl, error) {
+	dir := m.dirMaker(m.baseDir, info, ih)
+	return storage.NewMMapWithCompletion(dir, m.completion).OpenTorrent(ctx, info, ih)
+}
+
+func (m *mmapDirs) Close() error {
+	return m.completion.Close()
+}
+
+func newStorage(c Config, dirMaker storage.TorrentDirFilePathMaker) (storage.ClientImplCloser, error) {
+	dir := c.DownloadDirectory
+	switch c.Storage {
+	case "", StorageFile:
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return nil, fmt.Errorf("Failed to create download directory: %s", err)
+		}
+		completion, err := storage.NewDefaultPieceCompletionForDir(dir)
+		if err != nil {
+			completion = storage.NewMapPieceCompletion()
+		}
+		return storage.NewFileOpts(storage.NewFileClientOpts{
+			ClientBaseDir:   dir,
+			TorrentDirMaker: dirMaker,
+			PieceCompletion: completion,
+		}), nil
+	case StorageMMap:
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return nil, fmt.Errorf("Failed to create download directory: %s", err)
+		}
+		completion, err := storage.NewDefaultPieceCompletionForDir(dir)
+		if err != nil {
+			completion = storage.NewMapPieceCompletion()
+		}
+		return &mmapDirs{baseDir: dir, dirMaker: dirMaker, completion: completion}, nil
+	case StorageBolt:
+		dbdir := filepath.Join(dir, storageDir)
+		if err := os.MkdirAll(dbdir, 0755); err != nil {
+			return nil, fmt.Errorf("Failed to create storage directory: %s", err)
+		}
+		return newBoltStorage(dbdir)
+	case StorageSQLite:
+		dbdir := filepath.Join(dir, storageDir)
+		if err := os.MkdirAll(dbdir, 0755); err != nil {
+			return nil, fmt.Errorf("Failed to create storage directory: %s", err)
+		}
+		return newSQLiteStorage(filepath.Join(dbdir, "sqlite.db"))
+	}
+	return nil, fmt.Errorf("Invalid storage (%s)", c.Storage)
+}
+
+func newBoltStorage(dir string) (s storage.ClientImplCloser, err error) {
+	//anacrolix panics when the database cannot be opened
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("Failed to open bolt storage: %v", r)
+		}
+	}()
+	return storage.NewBoltDB(dir), nil
+}
+
+// OpenFile returns a reader for the torrent file at path, which
+// is relative to the download directory (torrent name included).
+// It is used to serve downloads when data is not stored as files.
+func (e *Engine) OpenFile(path string) (torrent.Reader, error) {
+	e.mut.Lock()
+	defer e.mut.Unlock()
+	for _, t := range e.ts {
+		for _, f := range t.Files {
+			if f != nil && f.f != nil && f.Path == path {
+				return f.f.NewReader(), nil
+			}
+		}
+	}
+	return nil, fmt.Errorf("Missing file %s", path)
+}
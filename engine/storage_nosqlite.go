@@ -0,0 +1,13 @@
+//go:build !cgo
+
+package engine
+
+import (
+	"fmt"
+
+	"github.com/anacrolix/torrent/storage"
+)
+
+func newSQLiteStorage(path string) (storage.ClientImplCloser, error) {
+	return nil, fmt.Errorf("sqlite storage requires a cgo build")
+}
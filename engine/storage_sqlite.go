@@ -0,0 +1,14 @@
+//go:build cgo
+
+package engine
+
+import (
+	"github.com/anacrolix/torrent/storage"
+	sqliteStorage "github.com/anacrolix/torrent/storage/sqlite"
+)
+
+func newSQLiteStorage(path string) (storage.ClientImplCloser, error) {
+	opts := sqliteStorage.NewDirectStorageOpts{}
+	opts.Path = path
+	return sqliteStorage.NewDirectStorage(opts)
+}
@@ -6,6 +6,8 @@ import (
 	"github.com/anacrolix/torrent"
 )
 
+const priorityNone = torrent.PiecePriorityNone
+
 type Torrent struct {
 	//anacrolix/torrent
 	InfoHash   string
@@ -17,10 +19,19 @@ type Torrent struct {
 	//cloud torrent
 	Started      bool
 	Dropped      bool
+	Private      bool
+	WebSeeds     []string
+	SavePath     string
+	Labels       []string
+	Owner        string
+	MaxConns     int
 	Percent      float32
 	DownloadRate float32
 	t            *torrent.Torrent
 	updatedAt    time.Time
+	pausedConns  int
+	forcePrivate bool
+	selected     map[string]bool
 }
 
 type File struct {
@@ -42,6 +53,66 @@ func (torrent *Torrent) Update(t *torrent.Torrent) {
 		torrent.updateLoaded(t)
 	}
 	torrent.t = t
+	torrent.updatePrivate()
+}
+
+// copy the torrent's exported fields (and its files),
+// the engine lock is held (see Engine.CopyTorrent)
+func (torrent *Torrent) copy() *Torrent {
+	c := &Torrent{}
+	*c = *torrent
+	c.WebSeeds = append([]string(nil), torrent.WebSeeds...)
+	c.Labels = append([]string(nil), torrent.Labels...)
+	if torrent.Files != nil {
+		c.Files = make([]*File, len(torrent.Files))
+		for i, f := range torrent.Files {
+			if f != nil {
+				fc := *f
+				c.Files[i] = &fc
+			}
+		}
+	}
+	c.selected = nil
+	return c
+}
+
+// download all files, or only the selected files
+func (torrent *Torrent) download() {
+	if torrent.selected == nil {
+		torrent.t.DownloadAll()
+		return
+	}
+	for _, f := range torrent.t.Files() {
+		if torrent.selected[f.Path()] {
+			f.Download()
+		} else {
+			f.SetPriority(priorityNone)
+		}
+	}
+}
+
+func (torrent *Torrent) addWebSeeds(urls []string) {
+	for _, u := range urls {
+		exists := false
+		for _, ws := range torrent.WebSeeds {
+			if ws == u {
+				exists = true
+				break
+			}
+		}
+		if !exists {
+			torrent.WebSeeds = append(torrent.WebSeeds, u)
+		}
+	}
+}
+
+// private torrents only use their trackers for peer
+// discovery, either due to their metainfo or by force
+func (torrent *Torrent) updatePrivate() {
+	torrent.Private = torrent.forcePrivate
+	if info := torrent.t.Info(); info != nil && info.Private != nil && *info.Private {
+		torrent.Private = true
+	}
 }
 
 func (torrent *Torrent) updateLoaded(t *torrent.Torrent) {
@@ -96,6 +167,25 @@ func (torrent *Torrent) updateLoaded(t *torrent.Torrent) {
 	torrent.updatedAt = now
 }
 
+// pause disconnects all peers and halts downloading
+// without dropping the torrent, undone with resume
+func (torrent *Torrent) pause() {
+	if torrent.t == nil || torrent.pausedConns > 0 {
+		return
+	}
+	torrent.t.DisallowDataDownload()
+	torrent.pausedConns = torrent.t.SetMaxEstablishedConns(0)
+}
+
+func (torrent *Torrent) resume() {
+	if torrent.t == nil || torrent.pausedConns == 0 {
+		return
+	}
+	torrent.t.SetMaxEstablishedConns(torrent.pausedConns)
+	torrent.t.AllowDataDownload()
+	torrent.pausedConns = 0
+}
+
 func percent(n, total int64) float32 {
 	if total == 0 {
 		return float32(0)
@@ -5,15 +5,23 @@ import (
 
 	"github.com/jpillora/cloud-torrent/server"
 	"github.com/jpillora/opts"
+	"golang.org/x/crypto/acme"
 )
 
 var version = "0.0.0-src" //set with ldflags
 
 func main() {
 	s := server.Server{
-		Title:      "Cloud Torrent",
-		Port:       3000,
-		ConfigPath: "cloud-torrent.json",
+		Title:         "Cloud Torrent",
+		Port:          3000,
+		ConfigPath:    "cloud-torrent.json",
+		TokensPath:    "cloud-torrent-tokens.json",
+		SharesPath:    "cloud-torrent-shares.json",
+		AuditPath:     "cloud-torrent-audit.log",
+		AuditSize:     10,
+		ACMEDirectory: acme.LetsEncryptURL,
+		ACMECache:     "cloud-torrent-certs",
+		OIDCUserClaim: "preferred_username",
 	}
 
 	o := opts.New(&s)
@@ -18,11 +18,11 @@ import (
 	"github.com/NYTimes/gziphandler"
 	"github.com/jpillora/cloud-torrent/engine"
 	"github.com/jpillora/cloud-torrent/static"
-	"github.com/jpillora/cookieauth"
 	"github.com/jpillora/requestlog"
 	"github.com/jpillora/scraper/scraper"
 	"github.com/jpillora/velox"
 	"github.com/skratchdot/open-golang/open"
+	"golang.org/x/crypto/acme"
 )
 
 //Server is the "State" portion of the diagram
@@ -32,32 +32,75 @@ type Server struct {
 	Port       int    `help:"Listening port" env:"PORT"`
 	Host       string `help:"Listening interface (default all)"`
 	Auth       string `help:"Optional basic auth in form 'user:password'" env:"AUTH"`
+	UsersPath  string `help:"Users file path, enables multi-user accounts with roles (the first admin is created from --auth)" env:"USERS_PATH"`
+	TokensPath string `help:"API tokens file path" env:"TOKENS_PATH"`
+	SharesPath string `help:"Share links file path" env:"SHARES_PATH"`
+	AuditPath  string `help:"Audit log file path (JSON lines), empty to disable" env:"AUDIT_PATH"`
+	AuditSize  int    `help:"Rotate the audit log at this size (MiB)" env:"AUDIT_SIZE"`
 	ConfigPath string `help:"Configuration file path"`
-	KeyPath    string `help:"TLS Key file path"`
+	KeyPath    string `help:"TLS Key file path (reloaded on change or SIGHUP, along with the certificate)"`
 	CertPath   string `help:"TLS Certicate file path" short:"r"`
+	ClientCA   string `help:"PEM CA bundle signing client certificates, required for API requests and changes (mutual TLS)" env:"CLIENT_CA"`
+	HTTPPort   int    `help:"Plain HTTP port (e.g. 80) redirecting to TLS and answering ACME http-01 challenges" env:"HTTP_PORT"`
 	Log        bool   `help:"Enable request logging"`
 	Open       bool   `help:"Open now with your default browser"`
+	//automatic tls
+	ACMEDomains     string `help:"Comma separated domains to obtain TLS certificates for with ACME" env:"ACME_DOMAINS"`
+	ACMEEmail       string `help:"ACME account contact email" env:"ACME_EMAIL"`
+	ACMEDirectory   string `help:"ACME directory URL" env:"ACME_DIRECTORY"`
+	ACMEDirectoryCA string `help:"PEM CA bundle trusted for the ACME directory (e.g. Pebble's)" env:"ACME_DIRECTORY_CA"`
+	ACMECache       string `help:"ACME certificate cache directory" env:"ACME_CACHE"`
+	//single sign-on, instead of --auth logins
+	ProxyAuthHeader  string `help:"Trust this user header (e.g. X-Forwarded-User) set by an authenticating proxy" env:"PROXY_AUTH_HEADER"`
+	TrustedProxies   string `help:"Comma separated proxy addresses (CIDRs) trusted to set the user header" env:"TRUSTED_PROXIES"`
+	OIDCIssuer       string `help:"OpenID Connect issuer URL, enables OIDC logins" env:"OIDC_ISSUER"`
+	OIDCClientID     string `help:"OpenID Connect client ID" env:"OIDC_CLIENT_ID"`
+	OIDCClientSecret string `help:"OpenID Connect client secret" env:"OIDC_CLIENT_SECRET"`
+	OIDCRedirectURL  string `help:"OpenID Connect redirect URL (default <this server>/auth/callback)" env:"OIDC_REDIRECT_URL"`
+	OIDCUserClaim    string `help:"ID token claim holding the user name" env:"OIDC_USER_CLAIM"`
+	//torrent url fetching
+	FetchDenyPrivate bool `help:"Deny fetching torrent URLs from private, loopback and link-local addresses" env:"FETCH_DENY_PRIVATE"`
 	//http handlers
 	files, static http.Handler
+	v1, qb        http.Handler
 	scraper       *scraper.Handler
 	scraperh      http.Handler
 	//torrent engine
-	engine *engine.Engine
-	state  struct {
-		velox.State
-		sync.Mutex
-		Config          engine.Config
-		SearchProviders scraper.Config
-		Downloads       *fsNode
-		Torrents        map[string]*engine.Torrent
-		Users           map[string]string
-		Stats           struct {
-			Title   string
-			Version string
-			Runtime string
-			Uptime  time.Time
-			System  stats
-		}
+	engine       *engine.Engine
+	client       *http.Client
+	transmission transmission
+	qbit         qbSessions
+	//multi-user accounts
+	users    *users
+	sessions sessions
+	throttle throttle
+	tokens   *tokens
+	shares   *shares
+	auditLog *auditLog
+	//signs the csrf tokens
+	csrfSecret []byte
+	//realtime state
+	state      serverState
+	userStates userStates
+}
+
+// serverState is synced to the web ui, users who may
+// only see their own torrents receive a filtered copy
+type serverState struct {
+	velox.State
+	sync.Mutex
+	Config          engine.Config
+	SearchProviders scraper.Config
+	Downloads       *fsNode
+	Torrents        map[string]*engine.Torrent
+	Users           map[string]*userConn
+	Stats           struct {
+		Title   string
+		Version string
+		Runtime string
+		Uptime  time.Time
+		System  stats
+		Engine  engine.Stats
 	}
 }
 
@@ -67,16 +110,27 @@ func (s *Server) Run(version string) error {
 	if isTLS && (s.CertPath == "" || s.KeyPath == "") {
 		return fmt.Errorf("You must provide both key and cert paths")
 	}
+	isACME := s.ACMEDomains != ""
+	if isTLS && isACME {
+		return fmt.Errorf("You must provide either key and cert paths or ACME domains")
+	}
+	isTLS = isTLS || isACME
+	if s.ClientCA != "" && !isTLS {
+		return fmt.Errorf("Client CA requires TLS")
+	}
 	s.state.Stats.Title = s.Title
 	s.state.Stats.Version = version
 	s.state.Stats.Runtime = strings.TrimPrefix(runtime.Version(), "go")
 	s.state.Stats.Uptime = time.Now()
 	s.state.Stats.System.pusher = velox.Pusher(&s.state)
 	//init maps
-	s.state.Users = map[string]string{}
+	s.state.Users = map[string]*userConn{}
+	s.csrfSecret = []byte(randomToken(32))
 	//will use a the local embed/ dir if it exists, otherwise will use the hardcoded embedded binaries
 	s.files = http.HandlerFunc(s.serveFiles)
 	s.static = ctstatic.FileSystemHandler()
+	s.v1 = s.v1Handler()
+	s.qb = s.qbHandler()
 	s.scraper = &scraper.Handler{
 		Log: false, Debug: false,
 		Headers: map[string]string{
@@ -89,15 +143,18 @@ func (s *Server) Run(version string) error {
 	}
 	//scraper
 	s.state.SearchProviders = s.scraper.Config //share scraper config
-	go s.fetchSearchConfigLoop()
 	s.scraperh = http.StripPrefix("/search", s.scraper)
 	//torrent engine
 	s.engine = engine.New()
+	//searches follow the engine's proxy setting
+	s.client = &http.Client{Transport: s.engine.Transport()}
+	http.DefaultClient.Transport = &searchTransport{s: s, next: http.DefaultClient.Transport}
 	//configure engine
 	c := engine.Config{
 		DownloadDirectory: "./downloads",
 		EnableUpload:      true,
 		AutoStart:         true,
+		Storage:           engine.StorageFile,
 	}
 	if _, err := os.Stat(s.ConfigPath); err == nil {
 		if b, err := ioutil.ReadFile(s.ConfigPath); err != nil {
@@ -114,6 +171,8 @@ func (s *Server) Run(version string) error {
 	if err := s.reconfigure(c); err != nil {
 		return fmt.Errorf("initial configure failed: %s", err)
 	}
+	//fetch search providers once the proxy is configured
+	go s.fetchSearchConfigLoop()
 	//poll torrents and files
 	go func() {
 		for {
@@ -122,6 +181,7 @@ func (s *Server) Run(version string) error {
 			s.state.Downloads = s.listFiles()
 			s.state.Unlock()
 			s.state.Push()
+			s.updateUserStates()
 			time.Sleep(1 * time.Second)
 		}
 	}()
@@ -129,6 +189,7 @@ func (s *Server) Run(version string) error {
 	go func() {
 		for {
 			c := s.engine.Config()
+			s.state.Stats.Engine = s.engine.Stats()
 			s.state.Stats.System.loadStats(c.DownloadDirectory)
 			time.Sleep(5 * time.Second)
 		}
@@ -153,24 +214,71 @@ func (s *Server) Run(version string) error {
 			open.Run(fmt.Sprintf("%s://%s:%d", proto, openhost, s.Port))
 		}()
 	}
+	//audit log
+	if s.AuditPath != "" {
+		a, err := openAuditLog(s.AuditPath, int64(s.AuditSize)<<20)
+		if err != nil {
+			return err
+		}
+		s.auditLog = a
+	}
 	//define handler chain, from last to first
-	h := http.Handler(http.HandlerFunc(s.handle))
+	h := http.Handler(s.audited(s.handle))
 	//gzip
 	compression := gzip.DefaultCompression
 	minSize := 0 //IMPORTANT
 	gzipWrap, _ := gziphandler.NewGzipLevelAndMinSize(compression, minSize)
 	h = gzipWrap(h)
+	inner := h
 	//auth
-	if s.Auth != "" {
-		user := s.Auth
-		pass := ""
-		if s := strings.SplitN(s.Auth, ":", 2); len(s) == 2 {
-			user = s[0]
-			pass = s[1]
-		}
-		h = cookieauth.New().SetUserPass(user, pass).Wrap(h)
+	if s.UsersPath != "" {
+		if err := s.initUsers(); err != nil {
+			return err
+		}
+	}
+	if s.ProxyAuthHeader != "" {
+		sso, err := s.proxyAuth(h)
+		if err != nil {
+			return err
+		}
+		h = sso
+	} else if s.OIDCIssuer != "" {
+		sso, err := s.oidcAuth(h)
+		if err != nil {
+			return err
+		}
+		h = sso
+	} else if s.users != nil {
+		h = s.authenticate(h)
+	} else if s.Auth != "" {
+		h = s.authenticate(h)
 		log.Printf("Enabled HTTP authentication")
 	}
+	//api tokens skip the login
+	tokens, err := loadTokens(s.TokensPath)
+	if err != nil {
+		return err
+	}
+	s.tokens = tokens
+	authed := s.bearer(inner, h)
+	//qbittorrent clients login with their own sessions
+	h = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, qbPrefix+"/") {
+			s.qb.ServeHTTP(w, r)
+			return
+		}
+		authed.ServeHTTP(w, r)
+	})
+	//share links skip the login
+	shares, err := loadShares(s.SharesPath)
+	if err != nil {
+		return err
+	}
+	s.shares = shares
+	h = s.shareLinks(h)
+	if s.ClientCA != "" {
+		h = s.clientCerts(h)
+	}
 	if s.Log {
 		h = requestlog.Wrap(h)
 	}
@@ -184,10 +292,54 @@ func (s *Server) Run(version string) error {
 		//handler stack
 		Handler: h,
 	}
+	//plain http redirects, and answers acme challenges
+	redirect := http.Handler(http.HandlerFunc(s.redirectHTTPS))
 	if isTLS {
-		return server.ListenAndServeTLS(s.CertPath, s.KeyPath)
+		//no h2, see above
+		server.TLSConfig = &tls.Config{NextProtos: []string{"http/1.1"}}
+	}
+	if isACME {
+		m, err := s.acmeManager()
+		if err != nil {
+			return err
+		}
+		redirect = m.HTTPHandler(redirect)
+		server.TLSConfig.GetCertificate = m.GetCertificate
+		server.TLSConfig.NextProtos = append(server.TLSConfig.NextProtos, acme.ALPNProto)
+	} else if isTLS {
+		//certificates are reloaded, no restart required
+		certs, err := loadCerts(s.CertPath, s.KeyPath)
+		if err != nil {
+			return err
+		}
+		go certs.watch()
+		server.TLSConfig.GetCertificate = certs.getCertificate
+	}
+	if s.ClientCA != "" {
+		pool, err := loadClientCAs(s.ClientCA)
+		if err != nil {
+			return err
+		}
+		server.TLSConfig.ClientCAs = pool
+		server.TLSConfig.ClientAuth = tls.VerifyClientCertIfGiven
+		log.Printf("Enabled client certificates for API requests and changes (%s)", s.ClientCA)
 	}
-	return server.ListenAndServe()
+	errs := make(chan error, 2)
+	if isTLS && s.HTTPPort > 0 {
+		httpAddr := fmt.Sprintf("%s:%d", host, s.HTTPPort)
+		log.Printf("Redirecting http://%s to TLS", httpAddr)
+		go func() {
+			errs <- http.ListenAndServe(httpAddr, redirect)
+		}()
+	}
+	go func() {
+		if isTLS {
+			errs <- server.ListenAndServeTLS("", "")
+		} else {
+			errs <- server.ListenAndServe()
+		}
+	}()
+	return <-errs
 }
 
 func (s *Server) reconfigure(c engine.Config) error {
@@ -207,6 +359,17 @@ func (s *Server) reconfigure(c engine.Config) error {
 }
 
 func (s *Server) handle(w http.ResponseWriter, r *http.Request) {
+	//enforce user roles
+	if role := requiredRole(r); !s.can(r, role) {
+		httpError(w, r, "Forbidden ("+role+" role required)", http.StatusForbidden)
+		return
+	}
+	//enforce csrf protection
+	s.setCSRFCookie(w, r)
+	if err := s.checkCSRF(r); err != nil {
+		httpError(w, r, err.Error(), http.StatusForbidden)
+		return
+	}
 	//handle realtime client library
 	if r.URL.Path == "/js/velox.js" {
 		velox.JS.ServeHTTP(w, r)
@@ -214,16 +377,41 @@ func (s *Server) handle(w http.ResponseWriter, r *http.Request) {
 	}
 	//handle realtime client connections
 	if r.URL.Path == "/sync" {
-		conn, err := velox.Sync(&s.state, w, r)
+		//non-admins sync their own filtered state
+		st := &s.state
+		if !s.seesAll(r) {
+			st = s.userState(requestUser(r))
+		}
+		conn, err := velox.Sync(st, w, r)
 		if err != nil {
 			log.Printf("sync failed: %s", err)
 			return
 		}
-		s.state.Users[conn.ID()] = r.RemoteAddr
+		uc := &userConn{
+			User:      s.owner(r),
+			IP:        clientIP(r),
+			UserAgent: r.UserAgent(),
+			Session:   s.requestSession(r),
+			Since:     time.Now().UTC(),
+			conn:      conn,
+		}
+		s.state.Lock()
+		s.state.Users[conn.ID()] = uc
+		s.state.Unlock()
+		st.Lock()
+		st.Users[conn.ID()] = uc
+		st.Unlock()
 		s.state.Push()
+		st.Push()
 		conn.Wait()
+		s.state.Lock()
 		delete(s.state.Users, conn.ID())
+		s.state.Unlock()
+		st.Lock()
+		delete(st.Users, conn.ID())
+		st.Unlock()
 		s.state.Push()
+		st.Push()
 		return
 	}
 	//search
@@ -231,10 +419,28 @@ func (s *Server) handle(w http.ResponseWriter, r *http.Request) {
 		s.scraperh.ServeHTTP(w, r)
 		return
 	}
+	//admin audit log
+	if r.URL.Path == "/api/audit" {
+		s.serveAudit(w, r)
+		return
+	}
+	//rest api
+	if isV1(r) {
+		s.v1.ServeHTTP(w, r)
+		return
+	}
+	//transmission clients
+	if r.URL.Path == "/transmission/rpc" {
+		s.serveTransmission(w, r)
+		return
+	}
 	//api call
 	if strings.HasPrefix(r.URL.Path, "/api/") {
-		//only pass request in, expect error out
-		if err := s.api(r); err == nil {
+		//only pass request in, expect result or error out
+		if result, err := s.api(r); err == nil && result != nil {
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(result)
+		} else if err == nil {
 			w.WriteHeader(http.StatusOK)
 			w.Write([]byte("OK"))
 		} else {
@@ -0,0 +1,76 @@
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// acmeManager obtains and renews certificates for the ACME
+// domains, answering tls-alpn-01 challenges on the tls port
+// and http-01 challenges on the http port (when enabled)
+func (s *Server) acmeManager() (*autocert.Manager, error) {
+	var domains []string
+	for _, d := range strings.Split(s.ACMEDomains, ",") {
+		if d = strings.TrimSpace(d); d != "" {
+			domains = append(domains, d)
+		}
+	}
+	client := &acme.Client{DirectoryURL: s.ACMEDirectory}
+	if s.ACMEDirectoryCA != "" {
+		b, err := os.ReadFile(s.ACMEDirectoryCA)
+		if err != nil {
+			return nil, fmt.Errorf("Read ACME directory CA error: %s", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(b) {
+			return nil, fmt.Errorf("Invalid ACME directory CA (expecting PEM)")
+		}
+		client.HTTPClient = &http.Client{
+			Transport: &http.Transport{
+				Proxy:           http.ProxyFromEnvironment,
+				TLSClientConfig: &tls.Config{RootCAs: pool},
+			},
+		}
+	}
+	if err := os.MkdirAll(s.ACMECache, 0700); err != nil {
+		return nil, fmt.Errorf("Create ACME cache error: %s", err)
+	}
+	log.Printf("Enabled ACME certificates for %s (%s)", strings.Join(domains, ", "), s.ACMEDirectory)
+	//tls-alpn-01 challenges are only sent to port 443
+	if s.HTTPPort == 0 && s.Port != 443 {
+		log.Printf("Warning: ACME tls-alpn-01 challenges are sent to port 443, not %d, set --http-port (e.g. 80) to answer http-01 challenges", s.Port)
+	}
+	return &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		Cache:      autocert.DirCache(s.ACMECache),
+		HostPolicy: autocert.HostWhitelist(domains...),
+		Email:      s.ACMEEmail,
+		Client:     client,
+	}, nil
+}
+
+// redirectHTTPS sends plain http requests to the tls port
+func (s *Server) redirectHTTPS(w http.ResponseWriter, r *http.Request) {
+	host, _, err := net.SplitHostPort(r.Host)
+	if err != nil {
+		host = r.Host
+	}
+	if s.Port != 443 {
+		host = net.JoinHostPort(host, strconv.Itoa(s.Port))
+	}
+	code := http.StatusPermanentRedirect
+	if r.Method == "GET" || r.Method == "HEAD" {
+		code = http.StatusMovedPermanently
+	}
+	http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), code)
+}
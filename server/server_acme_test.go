@@ -0,0 +1,365 @@
+package server
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/acme"
+)
+
+// acmeCA is a Pebble-style stand-in ACME server (RFC 8555),
+// offering one challenge type, which it validates against
+// the server's http or tls listener. JWS signatures are
+// not checked.
+type acmeCA struct {
+	*httptest.Server
+	t         *testing.T
+	challenge string
+	httpAddr  string
+	tlsAddr   string
+	key       *ecdsa.PrivateKey
+	cert      *x509.Certificate
+	mut       sync.Mutex
+	thumb     string
+	domain    string
+	token     string
+	status    string
+	chain     []byte
+	validated string
+}
+
+func newACMECA(t *testing.T, challenge string) *acmeCA {
+	ca := &acmeCA{t: t, challenge: challenge, status: "pending"}
+	var err error
+	if ca.key, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader); err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Stand-in ACME CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(24 * time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &ca.key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ca.cert, err = x509.ParseCertificate(der); err != nil {
+		t.Fatal(err)
+	}
+	ca.Server = httptest.NewTLSServer(http.HandlerFunc(ca.serve))
+	t.Cleanup(ca.Close)
+	return ca
+}
+
+// roots trusts the certificates the stand-in issues
+func (ca *acmeCA) roots() *x509.CertPool {
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.cert)
+	return pool
+}
+
+// directoryCA is a PEM file of the stand-in's own tls certificate
+func (ca *acmeCA) directoryCA() string {
+	path := filepath.Join(ca.t.TempDir(), "acme-ca.pem")
+	b := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.Certificate().Raw})
+	if err := os.WriteFile(path, b, 0600); err != nil {
+		ca.t.Fatal(err)
+	}
+	return path
+}
+
+func (ca *acmeCA) serve(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Replay-Nonce", strconv.FormatInt(time.Now().UnixNano(), 36))
+	w.Header().Set("Cache-Control", "no-store")
+	u := ca.URL
+	if r.URL.Path == "/dir" {
+		ca.json(w, http.StatusOK, map[string]interface{}{
+			"newNonce":   u + "/nonce",
+			"newAccount": u + "/account",
+			"newOrder":   u + "/order",
+			"revokeCert": u + "/revoke",
+			"keyChange":  u + "/key",
+			"meta":       map[string]string{"termsOfService": u + "/tos"},
+		})
+		return
+	}
+	if r.URL.Path == "/nonce" {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	//the rest are jws posts
+	jws := struct{ Protected, Payload string }{}
+	if err := json.NewDecoder(r.Body).Decode(&jws); err != nil || r.Method != "POST" {
+		http.Error(w, "expected jws", http.StatusBadRequest)
+		return
+	}
+	protected := struct {
+		JWK *struct{ X, Y string } `json:"jwk"`
+	}{}
+	b, _ := base64.RawURLEncoding.DecodeString(jws.Protected)
+	json.Unmarshal(b, &protected)
+	payload, _ := base64.RawURLEncoding.DecodeString(jws.Payload)
+	ca.mut.Lock()
+	defer ca.mut.Unlock()
+	switch r.URL.Path {
+	case "/account":
+		if protected.JWK == nil {
+			http.Error(w, "expected jwk", http.StatusBadRequest)
+			return
+		}
+		x, _ := base64.RawURLEncoding.DecodeString(protected.JWK.X)
+		y, _ := base64.RawURLEncoding.DecodeString(protected.JWK.Y)
+		pub := &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		thumb, err := acme.JWKThumbprint(pub)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		ca.thumb = thumb
+		w.Header().Set("Location", u+"/account/1")
+		ca.json(w, http.StatusCreated, map[string]string{"status": "valid"})
+	case "/order":
+		req := struct {
+			Identifiers []struct{ Value string }
+		}{}
+		json.Unmarshal(payload, &req)
+		if len(req.Identifiers) != 1 {
+			http.Error(w, "expected one identifier", http.StatusBadRequest)
+			return
+		}
+		ca.domain = req.Identifiers[0].Value
+		ca.token = strconv.FormatInt(time.Now().UnixNano(), 36)
+		ca.status = "pending"
+		w.Header().Set("Location", u+"/order/1")
+		ca.json(w, http.StatusCreated, ca.order())
+	case "/order/1":
+		ca.json(w, http.StatusOK, ca.order())
+	case "/authz/1":
+		ca.json(w, http.StatusOK, map[string]interface{}{
+			"status":     ca.status,
+			"identifier": map[string]string{"type": "dns", "value": ca.domain},
+			"challenges": []interface{}{ca.chal()},
+		})
+	case "/chal/1":
+		ca.status = "invalid"
+		if err := ca.validate(); err != nil {
+			ca.t.Logf("stand-in %s validation failed: %s", ca.challenge, err)
+		} else {
+			ca.status = "valid"
+			ca.validated = ca.challenge
+		}
+		ca.json(w, http.StatusOK, ca.chal())
+	case "/finalize/1":
+		req := struct{ CSR string }{}
+		json.Unmarshal(payload, &req)
+		der, _ := base64.RawURLEncoding.DecodeString(req.CSR)
+		csr, err := x509.ParseCertificateRequest(der)
+		if err != nil || ca.status != "valid" {
+			http.Error(w, "unauthorized or invalid csr", http.StatusForbidden)
+			return
+		}
+		leaf := &x509.Certificate{
+			SerialNumber: big.NewInt(time.Now().UnixNano()),
+			Subject:      pkix.Name{CommonName: ca.domain},
+			DNSNames:     csr.DNSNames,
+			NotBefore:    time.Now().Add(-time.Hour),
+			NotAfter:     time.Now().Add(90 * 24 * time.Hour),
+			KeyUsage:     x509.KeyUsageDigitalSignature,
+			ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		}
+		der, err = x509.CreateCertificate(rand.Reader, leaf, ca.cert, csr.PublicKey, ca.key)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		ca.chain = append(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+			pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.cert.Raw})...)
+		ca.status = "issued"
+		w.Header().Set("Location", u+"/order/1")
+		ca.json(w, http.StatusOK, ca.order())
+	case "/cert/1":
+		w.Header().Set("Content-Type", "application/pem-certificate-chain")
+		w.Write(ca.chain)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (ca *acmeCA) json(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func (ca *acmeCA) order() map[string]interface{} {
+	o := map[string]interface{}{
+		"identifiers":    []map[string]string{{"type": "dns", "value": ca.domain}},
+		"authorizations": []string{ca.URL + "/authz/1"},
+		"finalize":       ca.URL + "/finalize/1",
+	}
+	switch ca.status {
+	case "valid":
+		o["status"] = "ready"
+	case "issued":
+		o["status"] = "valid"
+		o["certificate"] = ca.URL + "/cert/1"
+	default:
+		o["status"] = ca.status
+	}
+	return o
+}
+
+func (ca *acmeCA) chal() map[string]string {
+	status := ca.status
+	if status == "issued" {
+		status = "valid"
+	}
+	return map[string]string{"type": ca.challenge, "url": ca.URL + "/chal/1", "token": ca.token, "status": status}
+}
+
+// validate the challenge as a CA would, must hold the lock
+func (ca *acmeCA) validate() error {
+	keyAuth := ca.token + "." + ca.thumb
+	switch ca.challenge {
+	case "http-01":
+		req, _ := http.NewRequest("GET", "http://"+ca.httpAddr+"/.well-known/acme-challenge/"+ca.token, nil)
+		req.Host = ca.domain
+		resp, err := http.DefaultTransport.RoundTrip(req)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		b, _ := io.ReadAll(resp.Body)
+		if resp.StatusCode != http.StatusOK || strings.TrimSpace(string(b)) != keyAuth {
+			return fmt.Errorf("got %d %q", resp.StatusCode, b)
+		}
+	case "tls-alpn-01":
+		conn, err := tls.Dial("tcp", ca.tlsAddr, &tls.Config{
+			ServerName:         ca.domain,
+			NextProtos:         []string{acme.ALPNProto},
+			InsecureSkipVerify: true,
+		})
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+		state := conn.ConnectionState()
+		if state.NegotiatedProtocol != acme.ALPNProto || len(state.PeerCertificates) == 0 {
+			return fmt.Errorf("expected %s", acme.ALPNProto)
+		}
+		//id-pe-acmeIdentifier holds the key authorization digest
+		sum := sha256.Sum256([]byte(keyAuth))
+		for _, ext := range state.PeerCertificates[0].Extensions {
+			var digest []byte
+			if ext.Id.Equal(asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 1, 31}) {
+				if _, err := asn1.Unmarshal(ext.Value, &digest); err == nil && bytes.Equal(digest, sum[:]) {
+					return nil
+				}
+			}
+		}
+		return fmt.Errorf("missing acme identifier")
+	}
+	return nil
+}
+
+func TestACME(t *testing.T) {
+	const domain = "cloud-torrent.test"
+	for _, challenge := range []string{"http-01", "tls-alpn-01"} {
+		t.Run(challenge, func(t *testing.T) {
+			ca := newACMECA(t, challenge)
+			l, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			s := &Server{
+				Port:            l.Addr().(*net.TCPAddr).Port,
+				ACMEDomains:     domain,
+				ACMEDirectory:   ca.URL + "/dir",
+				ACMEDirectoryCA: ca.directoryCA(),
+				ACMECache:       filepath.Join(t.TempDir(), "certs"),
+			}
+			m, err := s.acmeManager()
+			if err != nil {
+				t.Fatal(err)
+			}
+			//as in Run: the tls port answers tls-alpn-01 and
+			//the http port answers http-01 then redirects
+			redirect := httptest.NewServer(m.HTTPHandler(http.HandlerFunc(s.redirectHTTPS)))
+			defer redirect.Close()
+			tl := tls.NewListener(l, &tls.Config{
+				GetCertificate: m.GetCertificate,
+				NextProtos:     []string{"http/1.1", acme.ALPNProto},
+			})
+			defer tl.Close()
+			go http.Serve(tl, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Write([]byte("ok"))
+			}))
+			ca.httpAddr = redirect.Listener.Addr().String()
+			ca.tlsAddr = l.Addr().String()
+			//the first handshake obtains the certificate
+			client := &http.Client{
+				Timeout: 30 * time.Second,
+				Transport: &http.Transport{
+					TLSClientConfig: &tls.Config{ServerName: domain, RootCAs: ca.roots()},
+				},
+			}
+			resp, err := client.Get("https://" + ca.tlsAddr + "/")
+			if err != nil {
+				t.Fatal(err)
+			}
+			b, _ := io.ReadAll(resp.Body)
+			resp.Body.Close()
+			if string(b) != "ok" {
+				t.Fatalf("expected ok, got %q", b)
+			}
+			ca.mut.Lock()
+			validated := ca.validated
+			ca.mut.Unlock()
+			if validated != challenge {
+				t.Fatalf("expected a %s validation, got %q", challenge, validated)
+			}
+			if _, err := os.Stat(filepath.Join(s.ACMECache, domain)); err != nil {
+				t.Fatalf("expected the certificate to be cached: %s", err)
+			}
+			//other plain http requests are redirected
+			req, _ := http.NewRequest("GET", redirect.URL+"/download/file?x=1", nil)
+			req.Host = domain
+			resp, err = http.DefaultTransport.RoundTrip(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			expected := fmt.Sprintf("https://%s:%d/download/file?x=1", domain, s.Port)
+			if resp.StatusCode != http.StatusMovedPermanently || resp.Header.Get("Location") != expected {
+				t.Fatalf("expected a redirect to %s, got %d %s", expected, resp.StatusCode, resp.Header.Get("Location"))
+			}
+		})
+	}
+}
@@ -2,10 +2,14 @@ package server
 
 import (
 	"bytes"
+	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"net/http"
+	"path/filepath"
+	"slices"
 	"strings"
 
 	"github.com/anacrolix/torrent"
@@ -14,46 +18,91 @@ import (
 	"github.com/jpillora/cloud-torrent/engine"
 )
 
-func (s *Server) api(r *http.Request) error {
+// apiActions are the legacy /api/{action} actions, each is
+// documented in openapi.json (see server_v1_test.go)
+var apiActions = []string{"magnet", "url", "torrentfile", "add", "bulk", "configure", "torrent", "webseed", "file"}
+
+// api performs the given action, the optional result
+// is sent back as JSON, otherwise "OK" is sent
+func (s *Server) api(r *http.Request) (interface{}, error) {
 	defer r.Body.Close()
 	if r.Method != "POST" {
-		return fmt.Errorf("Invalid request method (expecting POST)")
+		return nil, fmt.Errorf("Invalid request method (expecting POST)")
 	}
 
 	action := strings.TrimPrefix(r.URL.Path, "/api/")
+	if !slices.Contains(apiActions, action) {
+		return nil, fmt.Errorf("Invalid action: %s", action)
+	}
 
 	data, err := ioutil.ReadAll(r.Body)
 	if err != nil {
-		return fmt.Errorf("Failed to download request body")
+		return nil, fmt.Errorf("Failed to download request body")
 	}
 
-	//convert url into torrent bytes
+	//convert url into torrent bytes (or a magnet)
 	if action == "url" {
-		url := string(data)
-		remote, err := http.Get(url)
+		var magnet string
+		data, magnet, err = s.fetchTorrent(string(data), nil)
 		if err != nil {
-			return fmt.Errorf("Invalid remote torrent URL: %s (%s)", err, url)
+			return nil, err
+		}
+		if magnet != "" {
+			data = []byte(magnet)
+			action = "magnet"
+		} else {
+			action = "torrentfile"
+		}
+	}
+
+	//add raw torrent bytes or magnet
+	if action == "torrentfile" || action == "magnet" {
+		req := addRequest{data: data}
+		if action == "magnet" {
+			req = addRequest{Magnet: string(data)}
 		}
-		//TODO enforce max body size (32k?)
-		data, err = ioutil.ReadAll(remote.Body)
+		result, err := s.add(r, req)
 		if err != nil {
-			return fmt.Errorf("Failed to download remote torrent: %s", err)
+			return nil, err
 		}
-		action = "torrentfile"
+		if result.Exists && !result.Merged {
+			return nil, fmt.Errorf("Torrent already exists (%s)", result.InfoHash)
+		}
+		return nil, nil
+	}
+
+	//add with options
+	if action == "add" {
+		return s.apiAdd(r, data)
 	}
 
-	//convert torrent bytes into magnet
-	if action == "torrentfile" {
-		reader := bytes.NewBuffer(data)
-		info, err := metainfo.Load(reader)
+	//one action across many torrents
+	if action == "bulk" {
+		req := engine.BulkRequest{}
+		if err := json.Unmarshal(data, &req); err != nil {
+			return nil, fmt.Errorf("Invalid bulk request: %s", err)
+		}
+		if !s.seesAll(r) {
+			req.Owner = s.owner(r)
+		}
+		results, err := s.engine.Bulk(req)
 		if err != nil {
-			return err
+			return nil, err
 		}
-		spec := torrent.TorrentSpecFromMetaInfo(info)
-		if err := s.engine.NewTorrent(spec); err != nil {
-			return fmt.Errorf("Torrent error: %s", err)
+		s.state.Push()
+		return results, nil
+	}
+
+	//torrent actions only apply to the user's own torrents
+	if action == "torrent" || action == "webseed" || action == "file" {
+		cmd := strings.Split(string(data), ":")
+		infohash := cmd[0]
+		if action != "webseed" && len(cmd) > 1 {
+			infohash = cmd[1]
+		}
+		if !s.ownsHash(r, infohash) {
+			return nil, fmt.Errorf("Missing torrent %s", infohash)
 		}
-		return nil
 	}
 
 	//update after action completes
@@ -64,59 +113,201 @@ func (s *Server) api(r *http.Request) error {
 	case "configure":
 		c := engine.Config{}
 		if err := json.Unmarshal(data, &c); err != nil {
-			return err
+			return nil, err
 		}
 		if err := s.reconfigure(c); err != nil {
-			return err
-		}
-	case "magnet":
-		uri := string(data)
-		if err := s.engine.NewMagnet(uri); err != nil {
-			return fmt.Errorf("Magnet error: %s", err)
+			return nil, err
 		}
 	case "torrent":
 		cmd := strings.SplitN(string(data), ":", 2)
 		if len(cmd) != 2 {
-			return fmt.Errorf("Invalid request")
+			return nil, fmt.Errorf("Invalid request")
 		}
 		state := cmd[0]
 		infohash := cmd[1]
 		if state == "start" {
 			if err := s.engine.StartTorrent(infohash); err != nil {
-				return err
+				return nil, err
 			}
 		} else if state == "stop" {
 			if err := s.engine.StopTorrent(infohash); err != nil {
-				return err
+				return nil, err
 			}
 		} else if state == "delete" {
 			if err := s.engine.DeleteTorrent(infohash); err != nil {
-				return err
+				return nil, err
+			}
+		} else if state == "private" || state == "public" {
+			if err := s.engine.SetPrivate(infohash, state == "private"); err != nil {
+				return nil, err
 			}
 		} else {
-			return fmt.Errorf("Invalid state: %s", state)
+			return nil, fmt.Errorf("Invalid state: %s", state)
+		}
+	case "webseed":
+		cmd := strings.SplitN(string(data), ":", 2)
+		if len(cmd) != 2 {
+			return nil, fmt.Errorf("Invalid request")
+		}
+		infohash := cmd[0]
+		urls := strings.Fields(cmd[1])
+		if err := s.engine.AddWebSeeds(infohash, urls); err != nil {
+			return nil, err
 		}
 	case "file":
 		cmd := strings.SplitN(string(data), ":", 3)
 		if len(cmd) != 3 {
-			return fmt.Errorf("Invalid request")
+			return nil, fmt.Errorf("Invalid request")
 		}
 		state := cmd[0]
 		infohash := cmd[1]
 		filepath := cmd[2]
 		if state == "start" {
 			if err := s.engine.StartFile(infohash, filepath); err != nil {
-				return err
+				return nil, err
 			}
 		} else if state == "stop" {
 			if err := s.engine.StopFile(infohash, filepath); err != nil {
-				return err
+				return nil, err
 			}
 		} else {
-			return fmt.Errorf("Invalid state: %s", state)
+			return nil, fmt.Errorf("Invalid state: %s", state)
+		}
+	default:
+		return nil, fmt.Errorf("Invalid action: %s", action)
+	}
+	return nil, nil
+}
+
+// addRequest is the body of the "add" action, containing
+// one of magnet, url or torrent (base64 encoded .torrent)
+type addRequest struct {
+	Magnet   string   `json:"magnet"`
+	URL      string   `json:"url"`
+	Torrent  string   `json:"torrent"`
+	SavePath string   `json:"savePath"`
+	Paused   bool     `json:"paused"`
+	Labels   []string `json:"labels"`
+	Files    []string `json:"files"`
+	Trackers []string `json:"trackers"`
+	WebSeeds []string `json:"webSeeds"`
+	Private  bool     `json:"private"`
+	Merge    bool     `json:"merge"`
+	//extra headers (e.g. Cookie) sent when fetching url
+	Headers map[string]string `json:"headers"`
+	//raw .torrent file
+	data []byte
+}
+
+type addResult struct {
+	InfoHash string `json:"infohash"`
+	Name     string `json:"name"`
+	//already added, (merged when requested)
+	Exists bool `json:"exists,omitempty"`
+	Merged bool `json:"merged,omitempty"`
+}
+
+// errAddedByOther is returned for duplicates of torrents the
+// user can't see, without naming them
+var errAddedByOther = errors.New("Torrent already added by another user")
+
+func (s *Server) apiAdd(r *http.Request, data []byte) (*addResult, error) {
+	req := addRequest{}
+	if err := json.Unmarshal(data, &req); err != nil {
+		return nil, fmt.Errorf("Invalid add request: %s", err)
+	}
+	return s.add(r, req)
+}
+
+// add performs an add request for any of the apis, the
+// torrent is owned by (and saved in the folder of) the user
+func (s *Server) add(r *http.Request, req addRequest) (*addResult, error) {
+	c := s.engine.Config()
+	if req.SavePath != "" && !filepath.IsLocal(filepath.Clean(req.SavePath)) {
+		return nil, fmt.Errorf("Invalid save path (%s)", req.SavePath)
+	}
+	if dir := s.userDir(r); dir != "" {
+		req.SavePath = filepath.Join(dir, req.SavePath)
+	}
+	opts := engine.AddOptions{
+		SavePath: req.SavePath,
+		Paused:   req.Paused,
+		Labels:   req.Labels,
+		Files:    req.Files,
+		Trackers: req.Trackers,
+		WebSeeds: req.WebSeeds,
+		Private:  req.Private,
+		Merge:    req.Merge || c.MergeDuplicates,
+		Owner:    s.owner(r),
+	}
+	var t *engine.Torrent
+	var err error
+	b := req.data
+	if req.URL != "" {
+		var magnet string
+		if b, magnet, err = s.fetchTorrent(req.URL, req.Headers); err != nil {
+			return nil, err
+		}
+		req.Magnet = magnet
+	}
+	if req.Magnet != "" && c.PrivateMagnets {
+		opts.Private = true
+	}
+	switch {
+	case req.Magnet != "":
+		t, err = s.engine.AddMagnet(req.Magnet, opts)
+		if err != nil && !errors.As(err, new(*engine.ExistsError)) {
+			return nil, fmt.Errorf("Magnet error: %s", err)
+		}
+	case b != nil || req.Torrent != "":
+		if b == nil {
+			b, err = base64.StdEncoding.DecodeString(req.Torrent)
 		}
+		if err != nil {
+			return nil, err
+		}
+		var spec *torrent.TorrentSpec
+		if spec, err = torrentSpec(b); err != nil {
+			return nil, err
+		}
+		t, err = s.engine.AddTorrent(spec, opts)
 	default:
-		return fmt.Errorf("Invalid action: %s", action)
+		return nil, fmt.Errorf("Missing magnet, url or torrent")
+	}
+	var exists *engine.ExistsError
+	if errors.As(err, &exists) {
+		if !s.owns(r, t) {
+			return nil, errAddedByOther
+		}
+		s.state.Push()
+		return &addResult{InfoHash: t.InfoHash, Name: t.Name, Exists: true, Merged: exists.Merged}, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("Torrent error: %s", err)
+	}
+	s.state.Push()
+	return &addResult{InfoHash: t.InfoHash, Name: t.Name}, nil
+}
+
+// savePath converts an absolute directory inside the download
+// directory (or the user's folder) into a save path relative to
+// the user's folder, as used by the compatibility apis
+func (s *Server) savePath(r *http.Request, dir string) (string, error) {
+	dldir := s.userDownloads(r)
+	rel, err := filepath.Rel(dldir, filepath.Clean(dir))
+	if err != nil || (rel != "." && !filepath.IsLocal(rel)) {
+		return "", fmt.Errorf("Save path must be inside %s", dldir)
+	}
+	if rel == "." {
+		return "", nil
+	}
+	return rel, nil
+}
+
+// torrentSpec parses .torrent file bytes
+func torrentSpec(data []byte) (*torrent.TorrentSpec, error) {
+	info, err := metainfo.Load(bytes.NewBuffer(data))
+	if err != nil {
+		return nil, err
 	}
-	return nil
+	return torrent.TorrentSpecFromMetaInfoErr(info)
 }
@@ -0,0 +1,414 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	//rotated audit files kept, as <path>.1 (newest) to <path>.N
+	auditKeep   = 5
+	auditTarget = 512
+	auditLimit  = 100
+	//queries keep offset+limit entries in memory
+	auditMaxLimit  = 1000
+	auditMaxOffset = 100000
+)
+
+// auditEntry is one line of the audit log
+type auditEntry struct {
+	Time   time.Time `json:"time"`
+	User   string    `json:"user,omitempty"`
+	Token  string    `json:"token,omitempty"`
+	IP     string    `json:"ip"`
+	Action string    `json:"action"`
+	Target string    `json:"target,omitempty"`
+	Result string    `json:"result"`
+}
+
+// auditLog is an append-only json-lines file,
+// rotated once it reaches its max size. queries read
+// files opened under the lock, so writes (and rotation)
+// continue meanwhile
+type auditLog struct {
+	mut     sync.Mutex
+	path    string
+	maxSize int64
+	file    *os.File
+	size    int64
+}
+
+func openAuditLog(path string, maxSize int64) (*auditLog, error) {
+	a := &auditLog{path: path, maxSize: maxSize}
+	if err := a.open(); err != nil {
+		return nil, fmt.Errorf("Open audit log error: %s", err)
+	}
+	log.Printf("Enabled audit log (%s)", path)
+	return a, nil
+}
+
+func (a *auditLog) open() error {
+	f, err := os.OpenFile(a.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	a.file = f
+	a.size = info.Size()
+	return nil
+}
+
+// rotate shifts <path>.N-1 to <path>.N, dropping the oldest,
+// and starts a new file, must hold the lock
+func (a *auditLog) rotate() error {
+	a.file.Close()
+	os.Remove(a.rotated(auditKeep))
+	for i := auditKeep - 1; i >= 1; i-- {
+		os.Rename(a.rotated(i), a.rotated(i+1))
+	}
+	if err := os.Rename(a.path, a.rotated(1)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return a.open()
+}
+
+func (a *auditLog) rotated(i int) string {
+	return a.path + "." + strconv.Itoa(i)
+}
+
+func (a *auditLog) write(e *auditEntry) error {
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	b = append(b, '\n')
+	a.mut.Lock()
+	defer a.mut.Unlock()
+	if a.maxSize > 0 && a.size > 0 && a.size+int64(len(b)) > a.maxSize {
+		if err := a.rotate(); err != nil {
+			return err
+		}
+	}
+	n, err := a.file.Write(b)
+	a.size += int64(n)
+	return err
+}
+
+// auditQuery filters and pages the audit log, newest first
+type auditQuery struct {
+	User   string
+	Action string
+	Target string
+	Since  time.Time
+	Until  time.Time
+	Offset int
+	Limit  int
+}
+
+func (q *auditQuery) match(e *auditEntry) bool {
+	return (q.User == "" || e.User == q.User) &&
+		(q.Action == "" || strings.Contains(e.Action, q.Action)) &&
+		(q.Target == "" || strings.Contains(e.Target, q.Target)) &&
+		(q.Since.IsZero() || !e.Time.Before(q.Since)) &&
+		(q.Until.IsZero() || e.Time.Before(q.Until))
+}
+
+// open the rotated files, oldest first, and the current one (up
+// to its size now), which stay readable as the log rotates
+func (a *auditLog) openFiles() ([]io.ReadCloser, error) {
+	a.mut.Lock()
+	defer a.mut.Unlock()
+	files := []io.ReadCloser{}
+	for i := auditKeep; i >= 0; i-- {
+		path := a.path
+		if i > 0 {
+			path = a.rotated(i)
+		}
+		f, err := os.Open(path)
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			for _, f := range files {
+				f.Close()
+			}
+			return nil, err
+		}
+		if i == 0 {
+			files = append(files, struct {
+				io.Reader
+				io.Closer
+			}{io.LimitReader(f, a.size), f})
+		} else {
+			files = append(files, f)
+		}
+	}
+	return files, nil
+}
+
+// query reads the rotated files and the current one (as they
+// were when the query started), keeping only the page
+func (a *auditLog) query(q auditQuery) ([]*auditEntry, int, error) {
+	files, err := a.openFiles()
+	if err != nil {
+		return nil, 0, err
+	}
+	//a ring of the newest offset+limit matches
+	keep := q.Offset + q.Limit
+	last := []*auditEntry{}
+	total := 0
+	for _, r := range files {
+		scanner := bufio.NewScanner(r)
+		scanner.Buffer(nil, 1<<20)
+		for scanner.Scan() {
+			e := &auditEntry{}
+			if json.Unmarshal(scanner.Bytes(), e) != nil || !q.match(e) {
+				continue
+			}
+			if len(last) < keep {
+				last = append(last, e)
+			} else if keep > 0 {
+				last[total%keep] = e
+			}
+			total++
+		}
+		r.Close()
+	}
+	if keep > 0 && len(last) == keep {
+		//unwrap the ring
+		start := total % keep
+		last = append(last[start:], last[:start]...)
+	}
+	page := []*auditEntry{}
+	for i := len(last) - 1 - q.Offset; i >= 0 && len(page) < q.Limit; i-- {
+		page = append(page, last[i])
+	}
+	return page, total, nil
+}
+
+// audit records an action, along with who caused it and from
+// where, to the audit log (or the server log when disabled)
+func (s *Server) audit(r *http.Request, action, target string, err error) {
+	e := &auditEntry{
+		Time:   time.Now().UTC(),
+		IP:     clientIP(r),
+		Action: action,
+		Target: target,
+		Result: "ok",
+	}
+	if u := requestUser(r); u != nil {
+		e.User = u.Name
+	}
+	if t := requestToken(r); t != nil {
+		e.Token = t.ID
+	}
+	if err != nil {
+		e.Result = err.Error()
+	}
+	if s.auditLog == nil {
+		log.Printf("[audit] %s %s: %s (%s token:%s %s)", action, target, e.Result, e.User, e.Token, e.IP)
+		return
+	}
+	if err := s.auditLog.write(e); err != nil {
+		log.Printf("Audit log error: %s", err)
+	}
+}
+
+// auditable requests change state, or use an api token
+func auditable(r *http.Request) bool {
+	if r.URL.Path == "/sync" || r.URL.Path == "/api/audit" {
+		return false
+	}
+	read := r.Method == "GET" || r.Method == "HEAD" || r.Method == "OPTIONS"
+	return !read || requestToken(r) != nil
+}
+
+// secrets in audited request bodies
+var (
+	auditSecretKey = regexp.MustCompile(`(?i)pass|secret|token|cookie|headers|authorization`)
+	auditUserinfo  = regexp.MustCompile(`://[^/@\s"]+@`)
+)
+
+// auditBody reads (and replaces) the request body, returning
+// it as an audit target when it's short text, with secrets
+// removed from json
+func auditBody(r *http.Request) string {
+	ct := r.Header.Get("Content-Type")
+	if r.Body == nil || strings.HasPrefix(ct, "multipart/") || strings.Contains(ct, "bittorrent") {
+		return ""
+	}
+	b, _ := io.ReadAll(io.LimitReader(r.Body, 64<<10))
+	r.Body = io.NopCloser(io.MultiReader(bytes.NewReader(b), r.Body))
+	var v interface{}
+	if json.Unmarshal(b, &v) == nil {
+		b, _ = json.Marshal(redact(v))
+	}
+	if !utf8.Valid(b) {
+		return ""
+	}
+	target := auditUserinfo.ReplaceAllString(string(b), "://***@")
+	if len(target) > auditTarget {
+		target = target[:auditTarget] + "..."
+	}
+	return target
+}
+
+func redact(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for k, e := range v {
+			if auditSecretKey.MatchString(k) {
+				v[k] = "***"
+			} else {
+				v[k] = redact(e)
+			}
+		}
+	case []interface{}:
+		for i, e := range v {
+			v[i] = redact(e)
+		}
+	}
+	return v
+}
+
+// auditResponse captures the result of an audited request
+type auditResponse struct {
+	http.ResponseWriter
+	status int
+	body   []byte
+}
+
+func (a *auditResponse) WriteHeader(status int) {
+	if a.status == 0 {
+		a.status = status
+	}
+	a.ResponseWriter.WriteHeader(status)
+}
+
+func (a *auditResponse) Write(b []byte) (int, error) {
+	if a.status == 0 {
+		a.status = http.StatusOK
+	}
+	if a.status >= 400 && len(a.body) < auditTarget {
+		a.body = append(a.body, b...)
+	}
+	return a.ResponseWriter.Write(b)
+}
+
+func (a *auditResponse) Unwrap() http.ResponseWriter {
+	return a.ResponseWriter
+}
+
+func (a *auditResponse) err() error {
+	if a.status < 400 {
+		return nil
+	}
+	msg := strings.TrimSpace(string(a.body))
+	if len(msg) > auditTarget {
+		msg = msg[:auditTarget]
+	}
+	if msg == "" {
+		msg = http.StatusText(a.status)
+	}
+	return fmt.Errorf("%d %s", a.status, msg)
+}
+
+// audited records the requests handled by h in the audit log
+func (s *Server) audited(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if s.auditLog == nil || !auditable(r) {
+			h(w, r)
+			return
+		}
+		target := auditBody(r)
+		if r.URL.Path == "/transmission/rpc" && !trMutating(target) {
+			h(w, r)
+			return
+		}
+		if target == "" && strings.HasPrefix(r.URL.Path, qbPrefix+"/") {
+			target = r.FormValue("hashes") + r.FormValue("urls")
+		}
+		aw := &auditResponse{ResponseWriter: w}
+		h(aw, r)
+		s.audit(r, r.Method+" "+r.URL.Path, target, aw.err())
+	}
+}
+
+// serveAudit pages through the audit log
+func (s *Server) serveAudit(w http.ResponseWriter, r *http.Request) {
+	if s.auditLog == nil {
+		http.Error(w, "Audit log is disabled", http.StatusNotFound)
+		return
+	}
+	if r.Method != "GET" {
+		http.Error(w, "Invalid request method (expecting GET)", http.StatusMethodNotAllowed)
+		return
+	}
+	v := r.URL.Query()
+	q := auditQuery{
+		User:   v.Get("user"),
+		Action: v.Get("action"),
+		Target: v.Get("target"),
+		Limit:  auditLimit,
+	}
+	var err error
+	for _, p := range []struct {
+		name string
+		t    *time.Time
+	}{{"since", &q.Since}, {"until", &q.Until}} {
+		if s := v.Get(p.name); s != "" {
+			if *p.t, err = time.Parse(time.RFC3339, s); err != nil {
+				http.Error(w, "Invalid "+p.name+" (expecting RFC3339)", http.StatusBadRequest)
+				return
+			}
+		}
+	}
+	for _, p := range []struct {
+		name string
+		n    *int
+	}{{"offset", &q.Offset}, {"limit", &q.Limit}} {
+		if s := v.Get(p.name); s != "" {
+			if *p.n, err = strconv.Atoi(s); err != nil || *p.n < 0 {
+				http.Error(w, "Invalid "+p.name, http.StatusBadRequest)
+				return
+			}
+		}
+	}
+	if q.Limit == 0 {
+		q.Limit = auditLimit
+	} else if q.Limit > auditMaxLimit {
+		http.Error(w, fmt.Sprintf("Invalid limit (max %d)", auditMaxLimit), http.StatusBadRequest)
+		return
+	}
+	if q.Offset > auditMaxOffset {
+		http.Error(w, fmt.Sprintf("Invalid offset (max %d)", auditMaxOffset), http.StatusBadRequest)
+		return
+	}
+	entries, total, err := s.auditLog.query(q)
+	if err != nil {
+		http.Error(w, "Audit log error: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		Total   int           `json:"total"`
+		Offset  int           `json:"offset"`
+		Limit   int           `json:"limit"`
+		Entries []*auditEntry `json:"entries"`
+	}{total, q.Offset, q.Limit, entries})
+}
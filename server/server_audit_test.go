@@ -0,0 +1,143 @@
+package server
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestAuditQuery(t *testing.T) {
+	a, err := openAuditLog(filepath.Join(t.TempDir(), "audit.log"), 1<<10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now().UTC()
+	const n = 30
+	for i := 0; i < n; i++ {
+		action := "add"
+		if i%2 == 1 {
+			action = "delete"
+		}
+		e := &auditEntry{Time: now.Add(time.Duration(i) * time.Second), Action: action, Target: fmt.Sprint(i), Result: "ok"}
+		if err := a.write(e); err != nil {
+			t.Fatal(err)
+		}
+	}
+	//spread over the rotated files, none dropped
+	if _, err := os.Stat(a.rotated(2)); err != nil {
+		t.Fatal("expected rotated files")
+	}
+	for _, c := range []struct {
+		q     auditQuery
+		total int
+		page  string
+	}{
+		{auditQuery{Limit: 3}, n, "29 28 27"},
+		{auditQuery{Offset: 2, Limit: 3}, n, "27 26 25"},
+		{auditQuery{Action: "delete", Limit: 2}, n / 2, "29 27"},
+		{auditQuery{Action: "add", Offset: 13, Limit: 5}, n / 2, "2 0"},
+		{auditQuery{Since: now.Add(27 * time.Second), Limit: 5}, 3, "29 28 27"},
+		{auditQuery{Offset: n, Limit: 5}, n, ""},
+	} {
+		page, total, err := a.query(c.q)
+		if err != nil {
+			t.Fatal(err)
+		}
+		targets := []string{}
+		for _, e := range page {
+			targets = append(targets, e.Target)
+		}
+		if got := strings.Join(targets, " "); total != c.total || got != c.page {
+			t.Fatalf("%+v: expected %d %q, got %d %q", c.q, c.total, c.page, total, got)
+		}
+	}
+}
+
+func TestAuditQueryWhileWriting(t *testing.T) {
+	a, err := openAuditLog(filepath.Join(t.TempDir(), "audit.log"), 1<<10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 200; i++ {
+			a.write(&auditEntry{Time: time.Now().UTC(), Action: "add", Result: "ok"})
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 50; i++ {
+			if _, _, err := a.query(auditQuery{Limit: 10}); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+	wg.Wait()
+}
+
+func TestAuditRotateDuringQuery(t *testing.T) {
+	a, err := openAuditLog(filepath.Join(t.TempDir(), "audit.log"), 1<<10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 5; i++ {
+		a.write(&auditEntry{Time: time.Now().UTC(), Action: "add", Target: fmt.Sprint(i), Result: "ok"})
+	}
+	//a query's files are opened, then the log rotates
+	//(more than it keeps) before they're read
+	files, err := a.openFiles()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 100; i++ {
+		if err := a.write(&auditEntry{Time: time.Now().UTC(), Action: "delete", Result: "ok"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	adds := 0
+	for _, f := range files {
+		b, _ := io.ReadAll(f)
+		f.Close()
+		adds += strings.Count(string(b), `"action":"add"`)
+		if strings.Contains(string(b), `"action":"delete"`) {
+			t.Fatal("expected only the entries from when the query started")
+		}
+	}
+	if adds != 5 {
+		t.Fatalf("expected 5 entries, got %d", adds)
+	}
+}
+
+func TestServeAuditLimits(t *testing.T) {
+	s := newTestServer(t, true)
+	a, err := openAuditLog(filepath.Join(t.TempDir(), "audit.log"), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.auditLog = a
+	for query, status := range map[string]int{
+		"":                             http.StatusOK,
+		"?limit=1000&offset=100000":    http.StatusOK,
+		"?limit=1001":                  http.StatusBadRequest,
+		"?limit=-1":                    http.StatusBadRequest,
+		"?offset=-1":                   http.StatusBadRequest,
+		"?offset=100001":               http.StatusBadRequest,
+		"?offset=99999999999999999999": http.StatusBadRequest,
+	} {
+		w := httptest.NewRecorder()
+		s.serveAudit(w, httptest.NewRequest("GET", "/api/audit"+query, nil))
+		if w.Code != status {
+			t.Fatalf("%q: expected %d, got %d %s", query, status, w.Code, w.Body)
+		}
+	}
+}
@@ -0,0 +1,78 @@
+package server
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/url"
+)
+
+const (
+	csrfHeader = "X-CSRF-Token"
+	csrfCookie = "cloudtorrent-csrf"
+)
+
+// csrfToken of the session with the given id (empty without
+// sessions), the web ui reads it from the csrf cookie and
+// sends it with each request
+func (s *Server) csrfToken(session string) string {
+	mac := hmac.New(sha256.New, s.csrfSecret)
+	mac.Write([]byte(session))
+	return hex.EncodeToString(mac.Sum(nil))[:32]
+}
+
+// setCSRFCookie gives the web ui the csrf token of
+// the request's session, when it doesn't have it yet
+func (s *Server) setCSRFCookie(w http.ResponseWriter, r *http.Request) {
+	token := s.csrfToken(s.requestSession(r))
+	if c, err := r.Cookie(csrfCookie); err == nil && c.Value == token {
+		return
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     csrfCookie,
+		Value:    token,
+		Path:     "/",
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// checkCSRF rejects requests which another site could have
+// made with the user's cookies: cross-origin syncs and
+// mutating requests without their session's csrf token
+func (s *Server) checkCSRF(r *http.Request) error {
+	//bearer tokens are never sent automatically
+	if requestToken(r) != nil {
+		return nil
+	}
+	read := r.Method == "GET" || r.Method == "HEAD" || r.Method == "OPTIONS"
+	if read && r.URL.Path != "/sync" {
+		return nil
+	}
+	origin := r.Header.Get("Origin")
+	if origin != "" {
+		if u, err := url.Parse(origin); err != nil || u.Host != r.Host {
+			return fmt.Errorf("Cross-origin request denied (%s)", origin)
+		}
+	}
+	//websockets and event streams can't send headers
+	if read {
+		return nil
+	}
+	//transmission clients send their rpc session id instead
+	if r.URL.Path == "/transmission/rpc" {
+		return nil
+	}
+	token := r.Header.Get(csrfHeader)
+	if token != "" && hmac.Equal([]byte(token), []byte(s.csrfToken(s.requestSession(r)))) {
+		return nil
+	}
+	//browsers always send an origin or referer with these,
+	//other clients (scripts with basic auth) can't be forged
+	if origin == "" && r.Header.Get("Referer") == "" {
+		return nil
+	}
+	return fmt.Errorf("Missing or invalid CSRF token")
+}
@@ -0,0 +1,167 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const (
+	fetchTimeout     = 30 * time.Second
+	fetchMaxSize     = 10 << 20
+	fetchMaxRedirect = 10
+)
+
+// magnetRedirect is returned by the redirect
+// policy when a url redirects to a magnet uri
+type magnetRedirect struct {
+	uri string
+}
+
+func (m *magnetRedirect) Error() string {
+	return "Redirected to magnet"
+}
+
+// fetchTorrent downloads a remote .torrent file, returning
+// either its contents or the magnet uri it redirected to
+func (s *Server) fetchTorrent(rawurl string, headers map[string]string) ([]byte, string, error) {
+	rawurl = strings.TrimSpace(rawurl)
+	if strings.HasPrefix(rawurl, "magnet:") {
+		return nil, rawurl, nil
+	}
+	u, err := url.Parse(rawurl)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, "", fmt.Errorf("Invalid torrent URL")
+	}
+	req, err := http.NewRequest("GET", u.String(), nil)
+	if err != nil {
+		return nil, "", err
+	}
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	client := s.fetchClient()
+	if s.FetchDenyPrivate {
+		if err := checkPublicHost(req.Context(), u.Hostname()); err != nil {
+			return nil, "", err
+		}
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		var m *magnetRedirect
+		if errors.As(err, &m) {
+			return nil, m.uri, nil
+		}
+		return nil, "", fmt.Errorf("Failed to fetch torrent: %s", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, "", fmt.Errorf("Failed to fetch torrent: %s", resp.Status)
+	}
+	if resp.ContentLength > fetchMaxSize {
+		return nil, "", fmt.Errorf("Torrent file too large (%d bytes)", resp.ContentLength)
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, fetchMaxSize+1))
+	if err != nil {
+		return nil, "", fmt.Errorf("Failed to fetch torrent: %s", err)
+	}
+	if len(data) > fetchMaxSize {
+		return nil, "", fmt.Errorf("Torrent file too large (over %d bytes)", fetchMaxSize)
+	}
+	//some trackers serve magnets as plain text
+	if b := bytes.TrimSpace(data); bytes.HasPrefix(b, []byte("magnet:")) {
+		return nil, string(b), nil
+	}
+	//bencoded metainfo is always a dictionary
+	if len(data) == 0 || data[0] != 'd' {
+		ct := resp.Header.Get("Content-Type")
+		if strings.HasPrefix(ct, "text/html") {
+			return nil, "", fmt.Errorf("Not a torrent file (got an HTML page, login required?)")
+		}
+		return nil, "", fmt.Errorf("Not a torrent file (content type %q)", ct)
+	}
+	return data, "", nil
+}
+
+// fetchClient returns an http client for remote torrents which
+// follows the engine proxy and optionally refuses private addresses
+func (s *Server) fetchClient() *http.Client {
+	var transport http.RoundTripper = s.engine.Transport()
+	if s.FetchDenyPrivate && s.engine.Config().Proxy == "" {
+		//check addresses at dial time, after dns resolution
+		t := http.DefaultTransport.(*http.Transport).Clone()
+		d := &net.Dialer{
+			Timeout:   fetchTimeout,
+			KeepAlive: 30 * time.Second,
+			Control: func(network, address string, c syscall.RawConn) error {
+				host, _, err := net.SplitHostPort(address)
+				if err != nil {
+					return err
+				}
+				return checkPublicIP(net.ParseIP(host))
+			},
+		}
+		t.DialContext = d.DialContext
+		transport = t
+	}
+	return &http.Client{
+		Transport: transport,
+		Timeout:   fetchTimeout,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if req.URL.Scheme == "magnet" {
+				return &magnetRedirect{uri: req.URL.String()}
+			}
+			if len(via) >= fetchMaxRedirect {
+				return fmt.Errorf("Too many redirects")
+			}
+			if req.URL.Scheme != "http" && req.URL.Scheme != "https" {
+				return fmt.Errorf("Invalid redirect scheme %q", req.URL.Scheme)
+			}
+			if s.FetchDenyPrivate {
+				if err := checkPublicHost(req.Context(), req.URL.Hostname()); err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+	}
+}
+
+// checkPublicHost resolves host and ensures none of
+// its addresses are private. when proxied, this is the
+// only check since the proxy performs the final dial.
+func checkPublicHost(ctx context.Context, host string) error {
+	if ip := net.ParseIP(host); ip != nil {
+		return checkPublicIP(ip)
+	}
+	ips, err := net.DefaultResolver.LookupIP(ctx, "ip", host)
+	if err != nil {
+		return fmt.Errorf("Failed to resolve %s: %s", host, err)
+	}
+	for _, ip := range ips {
+		if err := checkPublicIP(ip); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func checkPublicIP(ip net.IP) error {
+	if ip == nil || ip.IsPrivate() || ip.IsLoopback() || ip.IsUnspecified() ||
+		ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsMulticast() ||
+		cgnat.Contains(ip) {
+		return fmt.Errorf("Fetching from private address %s is denied", ip)
+	}
+	return nil
+}
+
+// carrier-grade nat shared address space (rfc 6598)
+var cgnat = &net.IPNet{IP: net.IP{100, 64, 0, 0}, Mask: net.CIDRMask(10, 32)}
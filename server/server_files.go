@@ -12,6 +12,7 @@ import (
 	"time"
 
 	"github.com/jpillora/archive"
+	"github.com/jpillora/cloud-torrent/engine"
 )
 
 const fileNumberLimit = 1000
@@ -26,6 +27,12 @@ type fsNode struct {
 func (s *Server) listFiles() *fsNode {
 	rootDir := s.state.Config.DownloadDirectory
 	root := &fsNode{}
+	if !s.state.Config.FileStorage() {
+		//data lives inside the storage database,
+		//so list the torrent files instead of the disk
+		listTorrents(s.state.Torrents, root)
+		return root
+	}
 	if info, err := os.Stat(rootDir); err == nil {
 		if err := list(rootDir, info, root, new(int)); err != nil {
 			log.Printf("File listing failed: %s", err)
@@ -39,12 +46,19 @@ func (s *Server) serveFiles(w http.ResponseWriter, r *http.Request) {
 		url := strings.TrimPrefix(r.URL.Path, "/download/")
 		//dldir is absolute
 		dldir := s.state.Config.DownloadDirectory
-		file := filepath.Join(dldir, url)
-		//only allow fetches/deletes inside the dl dir
-		if !strings.HasPrefix(file, dldir) || dldir == file {
+		file, ok := s.downloadPath(url)
+		if !ok {
 			http.Error(w, "Nice try\n"+dldir+"\n"+file, http.StatusBadRequest)
 			return
 		}
+		if !s.ownsPath(r, url) && !sharedRequest(r) {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		if !s.state.Config.FileStorage() {
+			s.serveTorrentFiles(w, r, filepath.ToSlash(strings.TrimPrefix(file, dldir+string(filepath.Separator))))
+			return
+		}
 		info, err := os.Stat(file)
 		if err != nil {
 			http.Error(w, "File stat error: "+err.Error(), http.StatusBadRequest)
@@ -80,6 +94,113 @@ func (s *Server) serveFiles(w http.ResponseWriter, r *http.Request) {
 	s.static.ServeHTTP(w, r)
 }
 
+// downloadPath joins url onto the download directory,
+// only allowing fetches/deletes inside the dl dir
+func (s *Server) downloadPath(url string) (string, bool) {
+	dldir := s.state.Config.DownloadDirectory
+	file := filepath.Join(dldir, url)
+	return file, strings.HasPrefix(file, dldir) && dldir != file
+}
+
+// serve files out of non-file storage via the engine.
+// files stream as they download, directories are zipped,
+// deletes are rejected since the data can only be removed
+// by deleting its torrent.
+func (s *Server) serveTorrentFiles(w http.ResponseWriter, r *http.Request, path string) {
+	if r.Method == "DELETE" {
+		http.Error(w, "Delete the torrent to remove its data ("+s.state.Config.Storage+" storage)", http.StatusMethodNotAllowed)
+		return
+	} else if r.Method != "GET" {
+		http.Error(w, "Not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	s.state.Lock()
+	var files []*engine.File
+	for _, t := range s.state.Torrents {
+		if !s.owns(r, t) && !sharedRequest(r) {
+			continue
+		}
+		for _, f := range t.Files {
+			if f.Path == path || strings.HasPrefix(f.Path, path+"/") {
+				files = append(files, f)
+			}
+		}
+	}
+	s.state.Unlock()
+	if len(files) == 0 {
+		http.Error(w, "File not found: "+path, http.StatusNotFound)
+		return
+	}
+	//single file
+	if len(files) == 1 && files[0].Path == path {
+		reader, err := s.engine.OpenFile(path)
+		if err != nil {
+			http.Error(w, "File open error: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		reader.SetContext(r.Context())
+		http.ServeContent(w, r, filepath.Base(path), time.Time{}, reader)
+		reader.Close()
+		return
+	}
+	//directory
+	w.Header().Set("Content-Type", "application/zip")
+	w.WriteHeader(200)
+	a := archive.NewZipWriter(w)
+	base := filepath.Base(path)
+	for _, f := range files {
+		reader, err := s.engine.OpenFile(f.Path)
+		if err != nil {
+			continue
+		}
+		reader.SetContext(r.Context())
+		name := base + strings.TrimPrefix(f.Path, path)
+		err = a.AddInfoReader(name, &torrentFileInfo{f}, reader)
+		reader.Close()
+		if err != nil {
+			break
+		}
+	}
+	a.Close()
+}
+
+// torrentFileInfo implements os.FileInfo for zipping
+type torrentFileInfo struct {
+	f *engine.File
+}
+
+func (i *torrentFileInfo) Name() string       { return filepath.Base(i.f.Path) }
+func (i *torrentFileInfo) Size() int64        { return i.f.Size }
+func (i *torrentFileInfo) Mode() os.FileMode  { return 0644 }
+func (i *torrentFileInfo) ModTime() time.Time { return time.Now() }
+func (i *torrentFileInfo) IsDir() bool        { return false }
+func (i *torrentFileInfo) Sys() interface{}   { return nil }
+
+// build a directory tree from torrent file paths
+func listTorrents(torrents map[string]*engine.Torrent, root *fsNode) {
+	for _, t := range torrents {
+		for _, f := range t.Files {
+			node := root
+			for _, name := range strings.Split(f.Path, "/") {
+				var child *fsNode
+				for _, c := range node.Children {
+					if c.Name == name {
+						child = c
+						break
+					}
+				}
+				if child == nil {
+					child = &fsNode{Name: name}
+					node.Children = append(node.Children, child)
+				}
+				child.Size += f.Size
+				node = child
+			}
+			root.Size += f.Size
+		}
+	}
+}
+
 //custom directory walk
 
 func list(path string, info os.FileInfo, node *fsNode, n *int) error {
@@ -0,0 +1,156 @@
+package server
+
+import (
+	"net/http"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/jpillora/cloud-torrent/engine"
+)
+
+// with multi-user accounts, torrents belong to the user who added
+// them and are saved in that user's folder of the download directory.
+// admins see everything, other users only see their own.
+
+// seesAll reports whether the request may see every torrent
+func (s *Server) seesAll(r *http.Request) bool {
+	u := requestUser(r)
+	return s.users == nil || (u != nil && u.Role == roleAdmin)
+}
+
+// owns reports whether the request may see and act on t
+func (s *Server) owns(r *http.Request, t *engine.Torrent) bool {
+	if s.seesAll(r) {
+		return true
+	}
+	u := requestUser(r)
+	return u != nil && t.Owner == u.Name
+}
+
+// ownsHash is owns by infohash, missing torrents are owned by no one
+func (s *Server) ownsHash(r *http.Request, infohash string) bool {
+	if s.seesAll(r) {
+		return true
+	}
+	s.state.Lock()
+	t, ok := s.state.Torrents[strings.ToLower(infohash)]
+	s.state.Unlock()
+	return ok && s.owns(r, t)
+}
+
+// owner of the torrents added by the request
+func (s *Server) owner(r *http.Request) string {
+	if u := requestUser(r); s.users != nil && u != nil {
+		return u.Name
+	}
+	return ""
+}
+
+// userDir is the request user's folder, relative to the download
+// directory, empty when users share the download directory
+func (s *Server) userDir(r *http.Request) string {
+	if !s.engine.Config().FileStorage() {
+		return ""
+	}
+	return s.owner(r)
+}
+
+// userDownloads is the absolute path of the request user's
+// folder, the default save path of the compatibility apis
+func (s *Server) userDownloads(r *http.Request) string {
+	return filepath.Join(s.engine.Config().DownloadDirectory, s.userDir(r))
+}
+
+// ownsPath reports whether the request may access the
+// download path rel (relative to the download directory)
+func (s *Server) ownsPath(r *http.Request, rel string) bool {
+	if s.seesAll(r) {
+		return true
+	}
+	rel = strings.Trim(path.Clean("/"+rel), "/")
+	if dir := s.userDir(r); dir != "" {
+		return rel == dir || strings.HasPrefix(rel, dir+"/")
+	}
+	//non-file storage, paths are torrent file paths
+	s.state.Lock()
+	defer s.state.Unlock()
+	for _, t := range s.state.Torrents {
+		if !s.owns(r, t) {
+			continue
+		}
+		for _, f := range t.Files {
+			if f.Path == rel || strings.HasPrefix(f.Path, rel+"/") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// userStates are the filtered states of connected users
+type userStates struct {
+	mut    sync.Mutex
+	states map[string]*serverState
+}
+
+// get the state of user u, creating it on first use
+func (s *Server) userState(u *user) *serverState {
+	us := &s.userStates
+	us.mut.Lock()
+	defer us.mut.Unlock()
+	if us.states == nil {
+		us.states = map[string]*serverState{}
+	}
+	st, ok := us.states[u.Name]
+	if !ok {
+		st = &serverState{Users: map[string]*userConn{}}
+		us.states[u.Name] = st
+		s.updateUserState(u.Name, st)
+	}
+	return st
+}
+
+// updateUserStates copies the server state into each
+// user state, keeping only that user's torrents and files
+func (s *Server) updateUserStates() {
+	us := &s.userStates
+	us.mut.Lock()
+	defer us.mut.Unlock()
+	for name, st := range us.states {
+		s.updateUserState(name, st)
+		st.Push()
+	}
+}
+
+func (s *Server) updateUserState(name string, st *serverState) {
+	s.state.Lock()
+	torrents := map[string]*engine.Torrent{}
+	for ih, t := range s.state.Torrents {
+		if t.Owner == name {
+			torrents[ih] = t
+		}
+	}
+	root := &fsNode{}
+	if !s.state.Config.FileStorage() {
+		listTorrents(torrents, root)
+	} else if s.state.Downloads != nil {
+		root.Name = s.state.Downloads.Name
+		root.Modified = s.state.Downloads.Modified
+		for _, c := range s.state.Downloads.Children {
+			if c.Name == name {
+				root.Children = []*fsNode{c}
+				root.Size = c.Size
+			}
+		}
+	}
+	st.Lock()
+	st.Config = s.state.Config.Redacted()
+	st.SearchProviders = s.state.SearchProviders
+	st.Stats = s.state.Stats
+	st.Torrents = torrents
+	st.Downloads = root
+	st.Unlock()
+	s.state.Unlock()
+}
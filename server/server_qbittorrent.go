@@ -0,0 +1,564 @@
+package server
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"net/http"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jpillora/cloud-torrent/engine"
+)
+
+// qBittorrent Web API v2 compatibility, see
+// https://github.com/qbittorrent/qBittorrent/wiki/WebUI-API-(qBittorrent-4.1)
+
+const (
+	qbPrefix        = "/api/v2"
+	qbCookie        = "SID"
+	qbSessionExpiry = time.Hour
+	qbVersion       = "v4.6.7"
+	qbAPIVersion    = "2.9.3"
+	//qbittorrent's "infinite" eta
+	qbInfinity = 8640000
+)
+
+// qbSessions are the cookie sessions of qbittorrent clients,
+// which don't use the web ui login
+type qbSessions struct {
+	mut      sync.Mutex
+	sessions map[string]*qbSession
+}
+
+type qbSession struct {
+	user string
+	seen time.Time
+}
+
+func (q *qbSessions) create(user string) string {
+	id := randomToken(16)
+	q.mut.Lock()
+	if q.sessions == nil {
+		q.sessions = map[string]*qbSession{}
+	}
+	q.sessions[id] = &qbSession{user: user, seen: time.Now()}
+	q.mut.Unlock()
+	return id
+}
+
+// valid checks and refreshes a session,
+// returning its user name
+func (q *qbSessions) valid(id string) (string, bool) {
+	q.mut.Lock()
+	defer q.mut.Unlock()
+	sess, ok := q.sessions[id]
+	if !ok {
+		return "", false
+	}
+	if time.Since(sess.seen) > qbSessionExpiry {
+		delete(q.sessions, id)
+		return "", false
+	}
+	sess.seen = time.Now()
+	return sess.user, true
+}
+
+func (q *qbSessions) remove(id string) {
+	q.mut.Lock()
+	delete(q.sessions, id)
+	q.mut.Unlock()
+}
+
+func (s *Server) qbHandler() http.Handler {
+	mux := http.NewServeMux()
+	authed := func(role string, h http.HandlerFunc) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			if !s.authEnabled() {
+				h(w, r)
+				return
+			}
+			c, err := r.Cookie(qbCookie)
+			if err != nil {
+				http.Error(w, "Forbidden", http.StatusForbidden)
+				return
+			}
+			name, ok := s.qbit.valid(c.Value)
+			if !ok {
+				http.Error(w, "Forbidden", http.StatusForbidden)
+				return
+			}
+			if s.users != nil {
+				u := s.users.get(name)
+				if u == nil {
+					http.Error(w, "Forbidden", http.StatusForbidden)
+					return
+				}
+				r = withUser(r, u)
+			}
+			if !s.can(r, role) {
+				http.Error(w, "Forbidden", http.StatusForbidden)
+				return
+			}
+			if role != roleViewer {
+				s.audited(h)(w, r)
+				return
+			}
+			h(w, r)
+		}
+	}
+	//read-only methods
+	route := func(p string, h http.HandlerFunc) {
+		mux.HandleFunc(qbPrefix+p, authed(roleViewer, h))
+	}
+	operate := func(p string, h http.HandlerFunc) {
+		mux.HandleFunc(qbPrefix+p, authed(roleOperator, h))
+	}
+	mux.HandleFunc(qbPrefix+"/auth/login", s.qbLogin)
+	route("/auth/logout", func(w http.ResponseWriter, r *http.Request) {
+		if c, err := r.Cookie(qbCookie); err == nil {
+			s.qbit.remove(c.Value)
+		}
+	})
+	route("/app/version", qbText(qbVersion))
+	route("/app/webapiVersion", qbText(qbAPIVersion))
+	route("/app/defaultSavePath", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(s.userDownloads(r)))
+	})
+	route("/app/preferences", s.qbPreferences)
+	mux.HandleFunc(qbPrefix+"/app/setPreferences", authed(roleAdmin, s.qbSetPreferences))
+	route("/transfer/info", s.qbTransferInfo)
+	route("/torrents/info", s.qbTorrentsInfo)
+	route("/torrents/files", s.qbTorrentFiles)
+	operate("/torrents/add", s.qbAdd)
+	route("/torrents/categories", s.qbCategories)
+	operate("/torrents/createCategory", func(w http.ResponseWriter, r *http.Request) {
+		//categories exist as long as a torrent uses them
+	})
+	operate("/torrents/setCategory", s.qbAction(func(t *engine.Torrent, r *http.Request) error {
+		labels := append([]string{}, t.Labels...)
+		if c := r.FormValue("category"); c == "" && len(labels) > 0 {
+			labels = labels[1:]
+		} else if len(labels) > 0 {
+			labels[0] = c
+		} else if c != "" {
+			labels = []string{c}
+		}
+		return s.engine.SetLabels(t.InfoHash, labels)
+	}))
+	pause := s.qbAction(func(t *engine.Torrent, r *http.Request) error {
+		if !t.Started {
+			return nil
+		}
+		return s.engine.StopTorrent(t.InfoHash)
+	})
+	resume := s.qbAction(func(t *engine.Torrent, r *http.Request) error {
+		if t.Started {
+			return nil
+		}
+		return s.engine.StartTorrent(t.InfoHash)
+	})
+	//v5 renamed pause/resume to stop/start
+	operate("/torrents/pause", pause)
+	operate("/torrents/stop", pause)
+	operate("/torrents/resume", resume)
+	operate("/torrents/start", resume)
+	operate("/torrents/recheck", s.qbAction(func(t *engine.Torrent, r *http.Request) error {
+		return s.engine.RecheckTorrent(t.InfoHash)
+	}))
+	operate("/torrents/delete", s.qbAction(func(t *engine.Torrent, r *http.Request) error {
+		if r.FormValue("deleteFiles") == "true" {
+			return s.engine.DeleteTorrentData(t.InfoHash)
+		}
+		return s.engine.DeleteTorrent(t.InfoHash)
+	}))
+	return mux
+}
+
+func qbText(s string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(s))
+	}
+}
+
+func qbJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+func (s *Server) qbLogin(w http.ResponseWriter, r *http.Request) {
+	name := r.FormValue("username")
+	if ok, wait := s.login(r, name, r.FormValue("password")); wait > 0 {
+		tooManyLogins(w, r, wait)
+		return
+	} else if !ok {
+		w.Write([]byte("Fails."))
+		return
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     qbCookie,
+		Value:    s.qbit.create(name),
+		Path:     "/",
+		HttpOnly: true,
+		SameSite: http.SameSiteStrictMode,
+	})
+	w.Write([]byte("Ok."))
+}
+
+// qbTorrents returns the torrents listed in the "hashes"
+// form value (separated by "|"), or all of them for "all",
+// of the user's torrents
+func (s *Server) qbTorrents(r *http.Request, hashes string) []*engine.Torrent {
+	want := map[string]bool{}
+	for _, h := range strings.Split(hashes, "|") {
+		want[strings.ToLower(h)] = true
+	}
+	s.state.Lock()
+	s.state.Torrents = s.engine.GetTorrents()
+	ts := []*engine.Torrent{}
+	for ih, t := range s.state.Torrents {
+		if (want["all"] || want[ih]) && s.owns(r, t) {
+			ts = append(ts, t)
+		}
+	}
+	s.state.Unlock()
+	sort.Slice(ts, func(i, j int) bool {
+		return ts[i].InfoHash < ts[j].InfoHash
+	})
+	return ts
+}
+
+// qbAction applies fn to each of the requested torrents
+func (s *Server) qbAction(fn func(t *engine.Torrent, r *http.Request) error) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		defer s.state.Push()
+		for _, t := range s.qbTorrents(r, r.FormValue("hashes")) {
+			if err := fn(t, r); err != nil {
+				http.Error(w, err.Error(), http.StatusConflict)
+				return
+			}
+		}
+	}
+}
+
+func (s *Server) qbTorrentsInfo(w http.ResponseWriter, r *http.Request) {
+	hashes := r.FormValue("hashes")
+	if hashes == "" {
+		hashes = "all"
+	}
+	_, hasCategory := r.Form["category"]
+	_, hasTag := r.Form["tag"]
+	list := []map[string]interface{}{}
+	for _, t := range s.qbTorrents(r, hashes) {
+		info := s.qbInfo(t)
+		if hasCategory && info["category"] != r.FormValue("category") {
+			continue
+		}
+		if hasTag && !qbHasTag(t, r.FormValue("tag")) {
+			continue
+		}
+		if !qbFilter(r.FormValue("filter"), t) {
+			continue
+		}
+		list = append(list, info)
+	}
+	qbJSON(w, list)
+}
+
+func qbHasTag(t *engine.Torrent, tag string) bool {
+	if tag == "" {
+		return len(t.Labels) == 0
+	}
+	for _, l := range t.Labels {
+		if l == tag {
+			return true
+		}
+	}
+	return false
+}
+
+func qbFilter(filter string, t *engine.Torrent) bool {
+	complete := t.Loaded && t.Percent >= 100
+	switch filter {
+	case "downloading":
+		return t.Started && !complete
+	case "seeding":
+		return t.Started && complete
+	case "completed":
+		return complete
+	case "paused", "stopped":
+		return !t.Started
+	case "resumed", "running":
+		return t.Started
+	case "active":
+		return t.DownloadRate > 0
+	case "inactive":
+		return t.DownloadRate == 0
+	case "stalled":
+		return t.Started && t.DownloadRate == 0
+	}
+	return true
+}
+
+// qbInfo describes a torrent as qbittorrent would
+func (s *Server) qbInfo(t *engine.Torrent) map[string]interface{} {
+	c := s.engine.Config()
+	complete := t.Loaded && t.Percent >= 100
+	left := t.Size - t.Downloaded
+	if left < 0 {
+		left = 0
+	}
+	var state string
+	switch {
+	case !t.Started && complete:
+		state = "pausedUP"
+	case !t.Started:
+		state = "pausedDL"
+	case !t.Loaded:
+		state = "metaDL"
+	case complete && c.EnableSeeding:
+		state = "uploading"
+	case complete:
+		state = "stalledUP"
+	case t.DownloadRate == 0:
+		state = "stalledDL"
+	default:
+		state = "downloading"
+	}
+	eta := qbInfinity
+	if complete {
+		eta = 0
+	} else if t.DownloadRate > 0 {
+		eta = int(float32(left) / t.DownloadRate)
+	}
+	category := ""
+	if len(t.Labels) > 0 {
+		category = t.Labels[0]
+	}
+	savePath := filepath.Join(c.DownloadDirectory, t.SavePath)
+	return map[string]interface{}{
+		"hash":         t.InfoHash,
+		"name":         t.Name,
+		"size":         t.Size,
+		"total_size":   t.Size,
+		"progress":     t.Percent / 100,
+		"dlspeed":      int(t.DownloadRate),
+		"upspeed":      0,
+		"downloaded":   t.Downloaded,
+		"uploaded":     0,
+		"amount_left":  left,
+		"completed":    t.Downloaded,
+		"ratio":        0,
+		"eta":          eta,
+		"state":        state,
+		"category":     category,
+		"tags":         strings.Join(t.Labels, ", "),
+		"save_path":    savePath,
+		"content_path": filepath.Join(savePath, t.Name),
+		"magnet_uri":   "magnet:?xt=urn:btih:" + t.InfoHash,
+		"private":      t.Private,
+		"priority":     0,
+		"num_seeds":    0,
+		"num_leechs":   0,
+		"added_on":     0,
+		"seq_dl":       false,
+		"auto_tmm":     false,
+	}
+}
+
+func (s *Server) qbTorrentFiles(w http.ResponseWriter, r *http.Request) {
+	ts := s.qbTorrents(r, r.FormValue("hash"))
+	if len(ts) != 1 {
+		http.Error(w, "Torrent hash was not found", http.StatusNotFound)
+		return
+	}
+	t := ts[0]
+	list := []map[string]interface{}{}
+	for i, f := range t.Files {
+		priority := 1
+		if t.Started && !f.Started {
+			priority = 0
+		}
+		list = append(list, map[string]interface{}{
+			"index":    i,
+			"name":     path.Join(t.Name, f.Path),
+			"size":     f.Size,
+			"progress": f.Percent / 100,
+			"priority": priority,
+			"is_seed":  f.Percent >= 100,
+		})
+	}
+	qbJSON(w, list)
+}
+
+func (s *Server) qbCategories(w http.ResponseWriter, r *http.Request) {
+	categories := map[string]interface{}{}
+	for _, t := range s.qbTorrents(r, "all") {
+		if len(t.Labels) > 0 {
+			categories[t.Labels[0]] = map[string]string{
+				"name":     t.Labels[0],
+				"savePath": s.userDownloads(r),
+			}
+		}
+	}
+	qbJSON(w, categories)
+}
+
+// qbAdd adds the "urls" (newline separated) and "torrents"
+// (uploaded files) of a multipart or urlencoded form
+func (s *Server) qbAdd(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseMultipartForm(32 << 20); err != nil && err != http.ErrNotMultipart {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	base := addRequest{
+		Paused: r.FormValue("paused") == "true" || r.FormValue("stopped") == "true",
+	}
+	if dir := r.FormValue("savepath"); dir != "" {
+		rel, err := s.savePath(r, dir)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		base.SavePath = rel
+	}
+	if c := r.FormValue("category"); c != "" {
+		base.Labels = append(base.Labels, c)
+	}
+	for _, tag := range strings.Split(r.FormValue("tags"), ",") {
+		if tag = strings.TrimSpace(tag); tag != "" {
+			base.Labels = append(base.Labels, tag)
+		}
+	}
+	var reqs []addRequest
+	for _, u := range strings.Split(r.FormValue("urls"), "\n") {
+		req := base
+		if u = strings.TrimSpace(u); u == "" {
+			continue
+		} else if strings.HasPrefix(u, "magnet:") {
+			req.Magnet = u
+		} else {
+			req.URL = u
+			if c := r.FormValue("cookie"); c != "" {
+				req.Headers = map[string]string{"Cookie": c}
+			}
+		}
+		reqs = append(reqs, req)
+	}
+	if r.MultipartForm != nil {
+		for _, fh := range r.MultipartForm.File["torrents"] {
+			f, err := fh.Open()
+			if err != nil {
+				continue
+			}
+			b, err := io.ReadAll(f)
+			f.Close()
+			if err != nil {
+				continue
+			}
+			req := base
+			req.Torrent = base64.StdEncoding.EncodeToString(b)
+			reqs = append(reqs, req)
+		}
+	}
+	added := 0
+	for _, req := range reqs {
+		if _, err := s.add(r, req); err == nil {
+			added++
+		}
+	}
+	if added == 0 {
+		http.Error(w, "Fails.", http.StatusUnsupportedMediaType)
+		return
+	}
+	w.Write([]byte("Ok."))
+}
+
+func (s *Server) qbPreferences(w http.ResponseWriter, r *http.Request) {
+	c := s.engine.Config()
+	encryption := 0
+	if c.DisableEncryption {
+		encryption = 2
+	}
+	qbJSON(w, map[string]interface{}{
+		"save_path":                s.userDownloads(r),
+		"listen_port":              c.IncomingPort,
+		"dht":                      !c.DisableDHT,
+		"pex":                      !c.DisablePEX,
+		"lsd":                      c.EnableLSD,
+		"encryption":               encryption,
+		"max_connec_per_torrent":   c.MaxConnsPerTorrent,
+		"start_paused_enabled":     !c.AutoStart,
+		"max_ratio_enabled":        false,
+		"max_seeding_time_enabled": false,
+		"queueing_enabled":         false,
+		"dl_limit":                 0,
+		"up_limit":                 0,
+	})
+}
+
+func (s *Server) qbSetPreferences(w http.ResponseWriter, r *http.Request) {
+	prefs := struct {
+		SavePath   *string `json:"save_path"`
+		ListenPort *int    `json:"listen_port"`
+		DHT        *bool   `json:"dht"`
+		PEX        *bool   `json:"pex"`
+		LSD        *bool   `json:"lsd"`
+		MaxConns   *int    `json:"max_connec_per_torrent"`
+	}{}
+	if err := json.Unmarshal([]byte(r.FormValue("json")), &prefs); err != nil {
+		http.Error(w, "Invalid json: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	c := s.engine.Config()
+	//clients echo back the advertised (user's) save path
+	if prefs.SavePath != nil && *prefs.SavePath != s.userDownloads(r) {
+		c.DownloadDirectory = *prefs.SavePath
+	}
+	if prefs.ListenPort != nil {
+		c.IncomingPort = *prefs.ListenPort
+	}
+	if prefs.DHT != nil {
+		c.DisableDHT = !*prefs.DHT
+	}
+	if prefs.PEX != nil {
+		c.DisablePEX = !*prefs.PEX
+	}
+	if prefs.LSD != nil {
+		c.EnableLSD = *prefs.LSD
+	}
+	if prefs.MaxConns != nil {
+		c.MaxConnsPerTorrent = *prefs.MaxConns
+	}
+	if err := s.reconfigure(c); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	}
+}
+
+func (s *Server) qbTransferInfo(w http.ResponseWriter, r *http.Request) {
+	var rate float32
+	var downloaded int64
+	for _, t := range s.qbTorrents(r, "all") {
+		rate += t.DownloadRate
+		downloaded += t.Downloaded
+	}
+	stats := s.engine.Stats()
+	status := "connected"
+	if stats.KillSwitch {
+		status = "disconnected"
+	}
+	qbJSON(w, map[string]interface{}{
+		"dl_info_speed":     int(rate),
+		"dl_info_data":      downloaded,
+		"up_info_speed":     0,
+		"up_info_data":      0,
+		"dl_rate_limit":     0,
+		"up_rate_limit":     0,
+		"dht_nodes":         stats.DHTNodes,
+		"connection_status": status,
+	})
+}
@@ -0,0 +1,47 @@
+package server
+
+import (
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+// search providers are configured with jpillora/scraper, which
+// only fetches with http.DefaultClient. Run sets searchTransport
+// as the default client's transport, sending requests to the
+// providers through the server's client (and so its proxy),
+// other requests of the default client are left to next.
+type searchTransport struct {
+	s    *Server
+	next http.RoundTripper
+}
+
+func (t *searchTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	//redirects go the way of the request which began them
+	origin := r
+	for origin.Response != nil && origin.Response.Request != nil {
+		origin = origin.Response.Request
+	}
+	if t.s.searchHost(origin.URL.Host) {
+		return t.s.client.Transport.RoundTrip(r)
+	}
+	next := t.next
+	if next == nil {
+		next = http.DefaultTransport
+	}
+	return next.RoundTrip(r)
+}
+
+var searchParam = regexp.MustCompile(`\{\{[^}]*\}\}`)
+
+// searchHost reports whether host is one of the search providers
+func (s *Server) searchHost(host string) bool {
+	for _, e := range s.scraper.Config {
+		u, err := url.Parse(searchParam.ReplaceAllString(e.URL, ""))
+		if err == nil && strings.EqualFold(u.Host, host) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,137 @@
+package server
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/jpillora/scraper/scraper"
+)
+
+type roundTripFunc func(*http.Request) (*http.Response, error)
+
+func (fn roundTripFunc) RoundTrip(r *http.Request) (*http.Response, error) {
+	return fn(r)
+}
+
+const searchPage = `<html><body><table>
+<tr class="r"><td class="n"> Ubuntu 24.04 </td><td><a href="magnet:?xt=urn:btih:abc&dn=ubuntu">m</a></td><td class="s">1.5 GB</td></tr>
+<tr class="r"><td class="n"> Debian 12 </td><td><a href="magnet:?xt=urn:btih:def&dn=debian">m</a></td><td class="s">700 MB</td></tr>
+<tr class="r"><td class="n">No magnet</td></tr>
+</table></body></html>`
+
+const searchConfig = `{
+	"test": {
+		"name": "Test",
+		"url": "http://search.example/q?s={{query}}&p={{page:1}}",
+		"list": "tr.r",
+		"result": {
+			"name": ["td.n", "trim()"],
+			"magnet": ["a", "@href"],
+			"hash": ["a", "@href", "/btih:(\\w+)/"],
+			"size": ["td.s", "s/ GB/G/"]
+		}
+	}
+}`
+
+func TestSearchUsesServerClient(t *testing.T) {
+	var requested, direct []string
+	respond := func(r *http.Request, status int, body string) *http.Response {
+		return &http.Response{
+			StatusCode: status,
+			Header:     http.Header{"Content-Type": {"text/html"}},
+			Body:       io.NopCloser(strings.NewReader(body)),
+			Request:    r,
+		}
+	}
+	s := &Server{
+		scraper: &scraper.Handler{Log: false},
+		client: &http.Client{Transport: roundTripFunc(func(r *http.Request) (*http.Response, error) {
+			requested = append(requested, r.URL.String())
+			if r.URL.Path == "/moved" {
+				res := respond(r, http.StatusFound, "")
+				res.Header.Set("Location", "http://mirror.example/q")
+				return res, nil
+			}
+			return respond(r, http.StatusOK, searchPage), nil
+		})},
+	}
+	if err := s.scraper.LoadConfig([]byte(searchConfig)); err != nil {
+		t.Fatal(err)
+	}
+	s.scraperh = http.StripPrefix("/search", s.scraper)
+	prev := http.DefaultClient.Transport
+	http.DefaultClient.Transport = &searchTransport{s: s, next: roundTripFunc(func(r *http.Request) (*http.Response, error) {
+		direct = append(direct, r.URL.String())
+		return respond(r, http.StatusOK, ""), nil
+	})}
+	t.Cleanup(func() { http.DefaultClient.Transport = prev })
+	search := func(path string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		s.scraperh.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		return w
+	}
+	w := search("/search/test?query=linux+iso")
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d %s", w.Code, w.Body)
+	}
+	if len(requested) != 1 || requested[0] != "http://search.example/q?s=linux+iso&p=1" {
+		t.Fatalf("expected one request via the server client, got %v", requested)
+	}
+	results := []map[string]string{}
+	if err := json.Unmarshal(w.Body.Bytes(), &results); err != nil {
+		t.Fatal(err)
+	}
+	expected := []map[string]string{
+		{"name": "Ubuntu 24.04", "magnet": "magnet:?xt=urn:btih:abc&dn=ubuntu", "hash": "abc", "size": "1.5G"},
+		{"name": "Debian 12", "magnet": "magnet:?xt=urn:btih:def&dn=debian", "hash": "def", "size": "700 MB"},
+	}
+	if len(results) != len(expected) {
+		t.Fatalf("expected %d results, got %v", len(expected), results)
+	}
+	for i, r := range results {
+		for k, v := range expected[i] {
+			if r[k] != v {
+				t.Fatalf("result %d: expected %s %q, got %q", i, k, v, r[k])
+			}
+		}
+	}
+	//unknown endpoints and missing params
+	if w := search("/search/nope"); w.Code != http.StatusNotFound {
+		t.Fatalf("expected 404, got %d", w.Code)
+	}
+	if w := search("/search/test"); w.Code != http.StatusInternalServerError || !strings.Contains(w.Body.String(), "Missing param: query") {
+		t.Fatalf("expected missing param error, got %d %s", w.Code, w.Body)
+	}
+	//redirects from providers stay on the server client,
+	//other default client requests don't use it
+	requested = nil
+	if _, err := http.Get("http://search.example/moved"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := http.Get("http://other.example/"); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(requested, " ") != "http://search.example/moved http://mirror.example/q" {
+		t.Fatalf("expected the redirect via the server client, got %v", requested)
+	}
+	if strings.Join(direct, " ") != "http://other.example/" {
+		t.Fatalf("expected only the other request to skip the server client, got %v", direct)
+	}
+}
+
+func TestSearchDefaultConfig(t *testing.T) {
+	s := &Server{scraper: &scraper.Handler{}}
+	//loading validates the selectors of each extractor
+	if err := s.scraper.LoadConfig(defaultSearchConfig); err != nil {
+		t.Fatal(err)
+	}
+	for _, host := range []string{"1337x.to", "thepiratebay.org"} {
+		if !s.searchHost(host) {
+			t.Fatalf("expected %s to be a search provider", host)
+		}
+	}
+}
@@ -5,7 +5,6 @@ import (
 	"encoding/json"
 	"io/ioutil"
 	"log"
-	"net/http"
 	"time"
 
 	"github.com/jpillora/backoff"
@@ -31,7 +30,7 @@ var fetches = 0
 var currentConfig, _ = normalize(defaultSearchConfig)
 
 func (s *Server) fetchSearchConfig() error {
-	resp, err := http.Get(searchConfigURL)
+	resp, err := s.client.Get(searchConfigURL)
 	if err != nil {
 		return err
 	}
@@ -0,0 +1,436 @@
+package server
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jpillora/velox"
+)
+
+const (
+	sessionCookie = "cloudtorrent"
+	sessionExpiry = 14 * 24 * time.Hour
+	//failed logins allowed before throttling
+	loginAttempts = 5
+	loginMaxDelay = 15 * time.Minute
+	//the user name backoff applies from every ip, so
+	//it's capped lower to limit how long others can
+	//keep an account locked out
+	loginUserMaxDelay = 1 * time.Minute
+)
+
+// sessions map cookie tokens onto signed in users
+type sessions struct {
+	mut      sync.Mutex
+	sessions map[string]*session
+	//tokens of the basic auth sessions, by basicKey
+	basic map[string]string
+}
+
+type session struct {
+	ID        string    `json:"id"`
+	User      string    `json:"user,omitempty"`
+	IP        string    `json:"ip"`
+	UserAgent string    `json:"userAgent"`
+	Created   time.Time `json:"created"`
+	LastSeen  time.Time `json:"lastSeen"`
+	Expires   time.Time `json:"expires"`
+	Current   bool      `json:"current,omitempty"`
+	//basicKey of the basic auth request which started it
+	basicKey string
+}
+
+// basicKey identifies a basic auth session by the credential
+// digest, ip and user agent of the requests which share it
+func basicKey(basic []byte, r *http.Request) string {
+	return string(basic) + "\x00" + clientIP(r) + "\x00" + r.UserAgent()
+}
+
+// create a session for the user name, returning its token,
+// basic is the credential digest when started by basic auth
+func (ss *sessions) create(name string, r *http.Request, basic []byte) (string, time.Time) {
+	token := randomToken(24)
+	now := time.Now().UTC()
+	expires := now.Add(sessionExpiry)
+	ss.mut.Lock()
+	defer ss.mut.Unlock()
+	if ss.sessions == nil {
+		ss.sessions = map[string]*session{}
+		ss.basic = map[string]string{}
+	}
+	//drop expired sessions as new ones are made
+	for t, sess := range ss.sessions {
+		if now.After(sess.Expires) {
+			ss.remove(t)
+		}
+	}
+	sess := &session{
+		ID:        randomToken(8),
+		User:      name,
+		IP:        clientIP(r),
+		UserAgent: r.UserAgent(),
+		Created:   now,
+		LastSeen:  now,
+		Expires:   expires,
+	}
+	if basic != nil {
+		sess.basicKey = basicKey(basic, r)
+		ss.basic[sess.basicKey] = token
+	}
+	ss.sessions[token] = sess
+	return token, expires
+}
+
+// remove the session with the given token, the lock is held
+func (ss *sessions) remove(token string) {
+	if sess, ok := ss.sessions[token]; ok && sess.basicKey != "" {
+		delete(ss.basic, sess.basicKey)
+	}
+	delete(ss.sessions, token)
+}
+
+// find the token of an unexpired session started by basic
+// auth with the same credentials, ip and user agent, so
+// repeated requests share one session (and skip bcrypt)
+func (ss *sessions) find(basic []byte, r *http.Request) (string, time.Time, bool) {
+	ss.mut.Lock()
+	defer ss.mut.Unlock()
+	token, ok := ss.basic[basicKey(basic, r)]
+	if !ok {
+		return "", time.Time{}, false
+	}
+	sess := ss.sessions[token]
+	now := time.Now().UTC()
+	if now.After(sess.Expires) {
+		ss.remove(token)
+		return "", time.Time{}, false
+	}
+	sess.LastSeen = now
+	return token, sess.Expires, true
+}
+
+// get the unexpired session with the given token
+// (updating its last use) or nil
+func (ss *sessions) get(token string, r *http.Request) *session {
+	ss.mut.Lock()
+	defer ss.mut.Unlock()
+	sess, ok := ss.sessions[token]
+	if !ok {
+		return nil
+	}
+	now := time.Now().UTC()
+	if now.After(sess.Expires) {
+		ss.remove(token)
+		return nil
+	}
+	sess.LastSeen = now
+	sess.IP = clientIP(r)
+	c := *sess
+	return &c
+}
+
+// user is the user name of the session with the given token
+func (ss *sessions) user(token string, r *http.Request) string {
+	if sess := ss.get(token, r); sess != nil {
+		return sess.User
+	}
+	return ""
+}
+
+// list the sessions of user, or all sessions when all is set
+func (ss *sessions) list(user string, all bool) []*session {
+	ss.mut.Lock()
+	defer ss.mut.Unlock()
+	now := time.Now()
+	list := []*session{}
+	for token, sess := range ss.sessions {
+		if now.After(sess.Expires) {
+			ss.remove(token)
+		} else if all || sess.User == user {
+			c := *sess
+			list = append(list, &c)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].LastSeen.After(list[j].LastSeen)
+	})
+	return list
+}
+
+// revoke the session with the given id
+func (ss *sessions) revoke(id string) *session {
+	ss.mut.Lock()
+	defer ss.mut.Unlock()
+	for token, sess := range ss.sessions {
+		if sess.ID == id {
+			ss.remove(token)
+			return sess
+		}
+	}
+	return nil
+}
+
+type sessionKey struct{}
+
+// withSession sets the token of a session started (or
+// resumed) by the request, before its cookie is sent
+func withSession(r *http.Request, token string) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), sessionKey{}, token))
+}
+
+// requestSession is the id of the request's session
+func (s *Server) requestSession(r *http.Request) string {
+	token, ok := r.Context().Value(sessionKey{}).(string)
+	if !ok {
+		if c, err := r.Cookie(sessionCookie); err == nil {
+			token = c.Value
+		}
+	}
+	if sess := s.sessions.get(token, r); sess != nil {
+		return sess.ID
+	}
+	return ""
+}
+
+func setSessionCookie(w http.ResponseWriter, r *http.Request, token string, expires time.Time) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookie,
+		Value:    token,
+		Path:     "/",
+		Expires:  expires,
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// userConn is a connected web ui, shown in the realtime state
+type userConn struct {
+	User      string
+	IP        string
+	UserAgent string
+	Session   string
+	Since     time.Time
+	conn      velox.Conn
+}
+
+// throttle delays repeated failed logins, per ip and
+// per user name, with exponential backoff. the user name
+// backoff applies from every ip (so rotating ips doesn't
+// skip it) and is capped at loginUserMaxDelay
+type throttle struct {
+	mut   sync.Mutex
+	fails map[string]*failures
+}
+
+type failures struct {
+	count int
+	last  time.Time
+	until time.Time
+}
+
+// throttleKeys are the ip key followed by the user key
+func throttleKeys(r *http.Request, name string) []string {
+	return []string{"ip:" + clientIP(r), "user:" + name}
+}
+
+// wait is how long until another login may be attempted
+func (t *throttle) wait(keys []string) time.Duration {
+	t.mut.Lock()
+	defer t.mut.Unlock()
+	wait := time.Duration(0)
+	for _, k := range keys {
+		f, ok := t.fails[k]
+		if !ok {
+			continue
+		}
+		if d := time.Until(f.until); d > wait {
+			wait = d
+		}
+	}
+	return wait
+}
+
+func (t *throttle) fail(keys []string) {
+	t.mut.Lock()
+	defer t.mut.Unlock()
+	now := time.Now()
+	if t.fails == nil {
+		t.fails = map[string]*failures{}
+	}
+	for k, f := range t.fails {
+		if now.Sub(f.last) > 24*time.Hour {
+			delete(t.fails, k)
+		}
+	}
+	for _, k := range keys {
+		f, ok := t.fails[k]
+		if !ok {
+			f = &failures{}
+			t.fails[k] = f
+		}
+		f.count++
+		f.last = now
+		maxDelay := loginMaxDelay
+		if strings.HasPrefix(k, "user:") {
+			maxDelay = loginUserMaxDelay
+		}
+		if n := f.count - loginAttempts; n >= 0 {
+			delay := time.Duration(math.Min(float64(time.Second)*math.Pow(2, float64(n)), float64(maxDelay)))
+			f.until = now.Add(delay)
+		}
+	}
+}
+
+func (t *throttle) reset(keys []string) {
+	t.mut.Lock()
+	defer t.mut.Unlock()
+	for _, k := range keys {
+		delete(t.fails, k)
+	}
+}
+
+// login checks the credentials of a user (or of --auth in
+// single user mode), failures are throttled, returning how
+// long to wait before trying again
+func (s *Server) login(r *http.Request, name, pass string) (bool, time.Duration) {
+	keys := throttleKeys(r, name)
+	if wait := s.throttle.wait(keys); wait > 0 {
+		return false, wait
+	}
+	//single sign-on alone has no passwords to check
+	ok := !s.authEnabled()
+	if s.users != nil {
+		ok = s.users.verify(name, pass) != nil
+	} else if s.Auth != "" {
+		user, p, _ := strings.Cut(s.Auth, ":")
+		u := subtle.ConstantTimeCompare([]byte(name), []byte(user))
+		pw := subtle.ConstantTimeCompare([]byte(pass), []byte(p))
+		ok = u&pw == 1
+	}
+	if !ok {
+		s.throttle.fail(keys)
+		s.audit(r, "login", name, fmt.Errorf("Invalid credentials"))
+		return false, 0
+	}
+	s.throttle.reset(keys)
+	return true, 0
+}
+
+// basicDigest identifies basic auth credentials, including
+// the stored password, so a password change invalidates it
+func (s *Server) basicDigest(name, pass string) []byte {
+	stored := s.Auth
+	if s.users != nil {
+		stored = ""
+		if u := s.users.get(name); u != nil {
+			stored = u.Hash
+		}
+	}
+	m := hmac.New(sha256.New, s.csrfSecret)
+	m.Write([]byte(name + "\x00" + pass + "\x00" + stored))
+	return m.Sum(nil)
+}
+
+func tooManyLogins(w http.ResponseWriter, r *http.Request, wait time.Duration) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+	httpError(w, r, "Too many failed logins, try again later", http.StatusTooManyRequests)
+}
+
+func unauthorized(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("WWW-Authenticate", `Basic realm="Cloud Torrent"`)
+	httpError(w, r, "Unauthorized", http.StatusUnauthorized)
+}
+
+// authenticate identifies users by session cookie or basic
+// auth (which starts a session, or resumes the one from the
+// same ip and user agent), users are reloaded from the
+// store on each request so changes apply immediately
+func (s *Server) authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name := ""
+		if c, err := r.Cookie(sessionCookie); err == nil {
+			name = s.sessions.user(c.Value, r)
+		}
+		if user, pass, ok := r.BasicAuth(); name == "" && ok {
+			basic := s.basicDigest(user, pass)
+			token, expires, found := s.sessions.find(basic, r)
+			if !found {
+				if ok, wait := s.login(r, user, pass); wait > 0 {
+					tooManyLogins(w, r, wait)
+					return
+				} else if !ok {
+					unauthorized(w, r)
+					return
+				}
+				token, expires = s.sessions.create(user, r, basic)
+				s.audit(r, "login", user, nil)
+			}
+			name = user
+			setSessionCookie(w, r, token, expires)
+			r = withSession(r, token)
+		}
+		u, ok := s.ssoUser(name)
+		if !ok {
+			unauthorized(w, r)
+			return
+		}
+		if u != nil {
+			r = withUser(r, u)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (s *Server) v1ListSessions(w http.ResponseWriter, r *http.Request) {
+	current := s.requestSession(r)
+	list := s.sessions.list(s.owner(r), s.seesAll(r))
+	for _, sess := range list {
+		sess.Current = sess.ID == current
+	}
+	v1Write(w, http.StatusOK, list)
+}
+
+func (s *Server) v1RevokeSession(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	found := false
+	for _, sess := range s.sessions.list(s.owner(r), s.seesAll(r)) {
+		found = found || sess.ID == id
+	}
+	var sess *session
+	if found {
+		sess = s.sessions.revoke(id)
+	}
+	if sess == nil {
+		v1Fail(w, http.StatusNotFound, fmt.Errorf("Missing session %s", id))
+		return
+	}
+	//disconnect its web uis
+	s.state.Lock()
+	for _, c := range s.state.Users {
+		if c.Session == id {
+			c.conn.Close()
+		}
+	}
+	s.state.Unlock()
+	v1Write(w, http.StatusNoContent, nil)
+}
@@ -0,0 +1,158 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBasicAuthSessionReuse(t *testing.T) {
+	s := newTestServer(t, true)
+	h := s.authenticate(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	get := func(user, pass string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", "/api/v1/torrents", nil)
+		r.SetBasicAuth(user, pass)
+		r.Header.Set("User-Agent", "curl/8")
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w
+	}
+	cookie := ""
+	for i := 0; i < 3; i++ {
+		w := get("admin", "password")
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected 200, got %d", w.Code)
+		}
+		c := w.Result().Cookies()
+		if len(c) != 1 || (cookie != "" && c[0].Value != cookie) {
+			t.Fatalf("expected the same session cookie, got %v", c)
+		}
+		cookie = c[0].Value
+	}
+	if n := len(s.sessions.list("", true)); n != 1 {
+		t.Fatalf("expected 1 session, got %d", n)
+	}
+	//a password change invalidates the remembered credentials
+	if err := s.users.put("admin", "changed", ""); err != nil {
+		t.Fatal(err)
+	}
+	if w := get("admin", "password"); w.Code != http.StatusUnauthorized {
+		t.Fatalf("expected 401 with the old password, got %d", w.Code)
+	}
+	if w := get("admin", "changed"); w.Code != http.StatusOK {
+		t.Fatalf("expected 200 with the new password, got %d", w.Code)
+	}
+}
+
+func TestThrottleOtherIPs(t *testing.T) {
+	s := newTestServer(t, true)
+	request := func(ip string) *http.Request {
+		r := httptest.NewRequest("POST", "/login", nil)
+		r.RemoteAddr = ip + ":1234"
+		return r
+	}
+	//failures past the throttle itself, as from many ips
+	for i := 0; i < loginAttempts+10; i++ {
+		s.throttle.fail(throttleKeys(request("192.0.2.1"), "admin"))
+	}
+	if _, wait := s.login(request("192.0.2.1"), "admin", "password"); wait <= loginUserMaxDelay {
+		t.Fatalf("expected the failing ip to wait longer than %s, got %s", loginUserMaxDelay, wait)
+	}
+	//other ips are held back by the user backoff, which is capped lower
+	if ok, wait := s.login(request("192.0.2.2"), "admin", "password"); ok || wait <= 0 || wait > loginUserMaxDelay {
+		t.Fatalf("expected another ip to wait at most %s, got ok=%v wait=%s", loginUserMaxDelay, ok, wait)
+	}
+	//other users aren't
+	if err := s.users.put("bob", "password123", roleViewer); err != nil {
+		t.Fatal(err)
+	}
+	if ok, wait := s.login(request("192.0.2.2"), "bob", "password123"); !ok || wait > 0 {
+		t.Fatalf("expected bob to login, got ok=%v wait=%s", ok, wait)
+	}
+}
+
+func TestBasicAuthSessionExpiry(t *testing.T) {
+	ss := &sessions{}
+	r := httptest.NewRequest("GET", "/", nil)
+	r.RemoteAddr = "192.0.2.1:1234"
+	token, _ := ss.create("admin", r, []byte("digest"))
+	if found, _, ok := ss.find([]byte("digest"), r); !ok || found != token {
+		t.Fatal("expected to find the basic auth session")
+	}
+	if _, _, ok := ss.find([]byte("other"), r); ok {
+		t.Fatal("expected other credentials not to find it")
+	}
+	//expired sessions are dropped as others are made
+	ss.sessions[token].Expires = time.Now().Add(-time.Second)
+	ss.create("bob", r, nil)
+	if _, ok := ss.sessions[token]; ok || len(ss.basic) != 0 {
+		t.Fatalf("expected the expired session to be removed, got %d sessions, %d basic", len(ss.sessions), len(ss.basic))
+	}
+	if _, _, ok := ss.find([]byte("digest"), r); ok {
+		t.Fatal("expected the expired session not to be found")
+	}
+}
+
+func TestCSRFSession(t *testing.T) {
+	s := newTestServer(t, true)
+	h := s.authenticate(http.HandlerFunc(s.handle))
+	login := httptest.NewRequest("GET", "/", nil)
+	a, _ := s.sessions.create("admin", login, nil)
+	b, _ := s.sessions.create("admin", login, nil)
+	tokenOf := func(session string) string {
+		return s.csrfToken(s.sessions.get(session, login).ID)
+	}
+	csrfCookieOf := func(w *httptest.ResponseRecorder) string {
+		for _, c := range w.Result().Cookies() {
+			if c.Name == csrfCookie {
+				return c.Value
+			}
+		}
+		return ""
+	}
+	post := func(session, token string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("POST", v1Prefix+"/torrents", strings.NewReader("{}"))
+		r.AddCookie(&http.Cookie{Name: sessionCookie, Value: session})
+		r.Header.Set("Origin", "http://example.com")
+		if token != "" {
+			r.Header.Set(csrfHeader, token)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w
+	}
+	//each session's token is sent in its csrf cookie
+	r := httptest.NewRequest("GET", v1Prefix+"/torrents", nil)
+	r.AddCookie(&http.Cookie{Name: sessionCookie, Value: a})
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	if c := csrfCookieOf(w); c == "" || c != tokenOf(a) || c == tokenOf(b) {
+		t.Fatalf("expected the csrf cookie of the session, got %q", c)
+	}
+	if w := post(a, tokenOf(a)); w.Code == http.StatusForbidden {
+		t.Fatalf("expected the session's token to pass, got %s", w.Body)
+	}
+	//tokens of the user's other sessions don't pass
+	if w := post(a, tokenOf(b)); w.Code != http.StatusForbidden {
+		t.Fatalf("expected 403 with another session's token, got %d", w.Code)
+	}
+	if w := post(a, ""); w.Code != http.StatusForbidden {
+		t.Fatalf("expected 403 without a token, got %d", w.Code)
+	}
+	//basic auth gets the token of the session it starts
+	r = httptest.NewRequest("GET", v1Prefix+"/torrents", nil)
+	r.SetBasicAuth("admin", "password")
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	session := ""
+	for _, c := range w.Result().Cookies() {
+		if c.Name == sessionCookie {
+			session = c.Value
+		}
+	}
+	if session == "" || csrfCookieOf(w) != tokenOf(session) {
+		t.Fatalf("expected the csrf cookie of the new session, got %q", csrfCookieOf(w))
+	}
+}
@@ -0,0 +1,266 @@
+package server
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const defaultShareExpiry = 24 * time.Hour
+
+// share is a signed link to a download path,
+// which needs no login until it expires
+type share struct {
+	ID           string    `json:"id"`
+	Path         string    `json:"path"`
+	User         string    `json:"user,omitempty"`
+	Created      time.Time `json:"created"`
+	Expires      time.Time `json:"expires"`
+	MaxDownloads int       `json:"maxDownloads,omitempty"`
+	Downloads    int       `json:"downloads"`
+	URL          string    `json:"url,omitempty"`
+}
+
+func (sh *share) active(now time.Time) bool {
+	return now.Before(sh.Expires) && (sh.MaxDownloads == 0 || sh.Downloads < sh.MaxDownloads)
+}
+
+// shares is the share store, persisted as json along
+// with the secret which signs the links
+type shares struct {
+	mut    sync.Mutex
+	path   string
+	Secret string            `json:"secret"`
+	Shares map[string]*share `json:"shares"`
+}
+
+func loadShares(path string) (*shares, error) {
+	ss := &shares{path: path, Shares: map[string]*share{}}
+	b, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("Read shares error: %s", err)
+	}
+	if len(b) > 0 {
+		if err := json.Unmarshal(b, ss); err != nil {
+			return nil, fmt.Errorf("Malformed shares file: %s", err)
+		}
+	}
+	if ss.Secret == "" {
+		ss.Secret = randomToken(32)
+	}
+	return ss, nil
+}
+
+// save writes the store atomically, dropping inactive
+// shares, must hold the lock
+func (ss *shares) save() error {
+	now := time.Now()
+	for id, sh := range ss.Shares {
+		if !sh.active(now) {
+			delete(ss.Shares, id)
+		}
+	}
+	b, _ := json.MarshalIndent(ss, "", "  ")
+	tmp := ss.path + ".tmp"
+	if err := os.WriteFile(tmp, b, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, ss.path)
+}
+
+// sign a share's id, path and expiry
+func (ss *shares) sign(id, p string, expires int64) string {
+	mac := hmac.New(sha256.New, []byte(ss.Secret))
+	fmt.Fprintf(mac, "%s\n%s\n%d", id, p, expires)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// link is the signed url of a share, relative to the server
+func (ss *shares) link(sh *share) string {
+	expires := sh.Expires.Unix()
+	q := url.Values{}
+	q.Set("share", sh.ID)
+	q.Set("expires", strconv.FormatInt(expires, 10))
+	q.Set("sig", ss.sign(sh.ID, sh.Path, expires))
+	return (&url.URL{Path: "/download/" + sh.Path, RawQuery: q.Encode()}).String()
+}
+
+func (ss *shares) create(sh share) (*share, error) {
+	sh.ID = randomToken(8)
+	sh.Created = time.Now().UTC()
+	ss.mut.Lock()
+	defer ss.mut.Unlock()
+	ss.Shares[sh.ID] = &sh
+	if err := ss.save(); err != nil {
+		delete(ss.Shares, sh.ID)
+		return nil, fmt.Errorf("Save shares error: %s", err)
+	}
+	c := sh
+	c.URL = ss.link(&c)
+	return &c, nil
+}
+
+// use verifies a share link for the download path p, and
+// counts a download when count is set
+func (ss *shares) use(p string, q url.Values, count bool) (*share, error) {
+	expires, _ := strconv.ParseInt(q.Get("expires"), 10, 64)
+	sig := ss.sign(q.Get("share"), p, expires)
+	if !hmac.Equal([]byte(sig), []byte(q.Get("sig"))) {
+		return nil, fmt.Errorf("Invalid link")
+	}
+	ss.mut.Lock()
+	defer ss.mut.Unlock()
+	sh, ok := ss.Shares[q.Get("share")]
+	if !ok || !sh.active(time.Now()) {
+		return nil, fmt.Errorf("Link expired")
+	}
+	if count {
+		sh.Downloads++
+		ss.save()
+	}
+	c := *sh
+	return &c, nil
+}
+
+// list the active shares
+func (ss *shares) list() []*share {
+	ss.mut.Lock()
+	defer ss.mut.Unlock()
+	now := time.Now()
+	list := []*share{}
+	for _, sh := range ss.Shares {
+		if sh.active(now) {
+			c := *sh
+			c.URL = ss.link(&c)
+			list = append(list, &c)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Created.Before(list[j].Created)
+	})
+	return list
+}
+
+func (ss *shares) revoke(id string) (*share, error) {
+	ss.mut.Lock()
+	defer ss.mut.Unlock()
+	sh, ok := ss.Shares[id]
+	if !ok {
+		return nil, fmt.Errorf("Missing share %s", id)
+	}
+	delete(ss.Shares, id)
+	if err := ss.save(); err != nil {
+		ss.Shares[id] = sh
+		return nil, fmt.Errorf("Save shares error: %s", err)
+	}
+	return sh, nil
+}
+
+type shareKey struct{}
+
+// sharedRequest reports whether the request was
+// authorized by a share link
+func sharedRequest(r *http.Request) bool {
+	return r.Context().Value(shareKey{}) != nil
+}
+
+// shareLinks serves /download/ requests carrying a share
+// link signature, bypassing the login. other requests are
+// passed to next.
+func (s *Server) shareLinks(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasPrefix(r.URL.Path, "/download/") || !r.URL.Query().Has("sig") {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if r.Method != "GET" && r.Method != "HEAD" {
+			http.Error(w, "Not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		p := strings.TrimPrefix(r.URL.Path, "/download/")
+		//resumed downloads are not counted again
+		rng := r.Header.Get("Range")
+		count := r.Method == "GET" && (rng == "" || strings.HasPrefix(rng, "bytes=0-"))
+		sh, err := s.shares.use(p, r.URL.Query(), count)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+		r = r.WithContext(context.WithValue(r.Context(), shareKey{}, sh))
+		if count {
+			s.audit(r, "share download", sh.ID+" "+sh.Path, nil)
+		}
+		s.files.ServeHTTP(w, r)
+	})
+}
+
+// shareRequest creates a share link
+type shareRequest struct {
+	Path         string     `json:"path"`
+	Expires      *time.Time `json:"expires"`
+	MaxDownloads int        `json:"maxDownloads"`
+}
+
+func (s *Server) v1ListShares(w http.ResponseWriter, r *http.Request) {
+	v1Write(w, http.StatusOK, s.shares.list())
+}
+
+func (s *Server) v1CreateShare(w http.ResponseWriter, r *http.Request) {
+	req := shareRequest{}
+	if !v1Read(w, r, &req) {
+		return
+	}
+	p := strings.Trim(path.Clean("/"+req.Path), "/")
+	file, ok := s.downloadPath(p)
+	if req.Path == "" || !ok || !s.ownsPath(r, p) {
+		v1Fail(w, http.StatusBadRequest, fmt.Errorf("Invalid path"))
+		return
+	}
+	if _, err := os.Stat(file); s.state.Config.FileStorage() && err != nil {
+		v1Fail(w, http.StatusNotFound, fmt.Errorf("File not found"))
+		return
+	}
+	if req.MaxDownloads < 0 {
+		v1Fail(w, http.StatusBadRequest, fmt.Errorf("Invalid download limit"))
+		return
+	}
+	expires := time.Now().Add(defaultShareExpiry)
+	if req.Expires != nil {
+		if req.Expires.Before(time.Now()) {
+			v1Fail(w, http.StatusBadRequest, fmt.Errorf("Share expiry is in the past"))
+			return
+		}
+		expires = *req.Expires
+	}
+	sh, err := s.shares.create(share{
+		Path:         p,
+		User:         s.owner(r),
+		Expires:      expires.UTC().Truncate(time.Second),
+		MaxDownloads: req.MaxDownloads,
+	})
+	if err != nil {
+		v1Fail(w, http.StatusInternalServerError, err)
+		return
+	}
+	v1Write(w, http.StatusCreated, sh)
+}
+
+func (s *Server) v1RevokeShare(w http.ResponseWriter, r *http.Request) {
+	if _, err := s.shares.revoke(r.PathValue("id")); err != nil {
+		v1Fail(w, http.StatusNotFound, err)
+		return
+	}
+	v1Write(w, http.StatusNoContent, nil)
+}
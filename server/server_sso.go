@@ -0,0 +1,407 @@
+package server
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math/big"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// single sign-on, either from a trusted authenticating
+// proxy or with an OpenID Connect provider. with the users
+// store, identities must match an existing user.
+
+const (
+	oidcCallback = "/auth/callback"
+	oidcLogin    = 10 * time.Minute
+)
+
+// ssoUser resolves a signed in identity, nil when unknown
+func (s *Server) ssoUser(name string) (*user, bool) {
+	if s.users == nil {
+		return nil, name != ""
+	}
+	u := s.users.get(name)
+	return u, u != nil
+}
+
+// proxyAuth trusts the user header of requests from the
+// proxy addresses, all other requests are rejected
+func (s *Server) proxyAuth(next http.Handler) (http.Handler, error) {
+	var nets []*net.IPNet
+	for _, c := range strings.Split(s.TrustedProxies, ",") {
+		c = strings.TrimSpace(c)
+		if c == "" {
+			continue
+		}
+		if !strings.Contains(c, "/") {
+			if strings.Contains(c, ":") {
+				c += "/128"
+			} else {
+				c += "/32"
+			}
+		}
+		_, n, err := net.ParseCIDR(c)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid proxy CIDR: %s", err)
+		}
+		nets = append(nets, n)
+	}
+	if len(nets) == 0 {
+		return nil, fmt.Errorf("Proxy authentication requires the trusted proxies")
+	}
+	trusted := func(r *http.Request) bool {
+		host, _, _ := net.SplitHostPort(r.RemoteAddr)
+		ip := net.ParseIP(host)
+		for _, n := range nets {
+			if ip != nil && n.Contains(ip) {
+				return true
+			}
+		}
+		return false
+	}
+	log.Printf("Enabled proxy authentication (%s)", s.ProxyAuthHeader)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name := r.Header.Get(s.ProxyAuthHeader)
+		if !trusted(r) || name == "" {
+			httpError(w, r, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		u, ok := s.ssoUser(name)
+		if !ok {
+			httpError(w, r, "Unknown user "+name, http.StatusForbidden)
+			return
+		}
+		if u != nil {
+			r = withUser(r, u)
+		}
+		next.ServeHTTP(w, r)
+	}), nil
+}
+
+// oidc is an OpenID Connect relying party using the
+// authorization code flow (with PKCE)
+type oidc struct {
+	mut       sync.Mutex
+	issuer    string
+	client    *http.Client
+	discovery *oidcDiscovery
+	keys      map[string]crypto.PublicKey
+	pending   map[string]*oidcPending
+}
+
+type oidcDiscovery struct {
+	Issuer        string `json:"issuer"`
+	AuthEndpoint  string `json:"authorization_endpoint"`
+	TokenEndpoint string `json:"token_endpoint"`
+	JWKSURI       string `json:"jwks_uri"`
+}
+
+// oidcPending is a login waiting for its callback
+type oidcPending struct {
+	nonce    string
+	verifier string
+	redirect string
+	returnTo string
+	expires  time.Time
+}
+
+// discover fetches (once) the provider configuration
+func (o *oidc) discover() (*oidcDiscovery, error) {
+	o.mut.Lock()
+	defer o.mut.Unlock()
+	if o.discovery != nil {
+		return o.discovery, nil
+	}
+	d := &oidcDiscovery{}
+	if err := o.getJSON(strings.TrimSuffix(o.issuer, "/")+"/.well-known/openid-configuration", d); err != nil {
+		return nil, fmt.Errorf("OIDC discovery failed: %s", err)
+	}
+	if d.Issuer != o.issuer {
+		return nil, fmt.Errorf("OIDC issuer mismatch (%s)", d.Issuer)
+	}
+	o.discovery = d
+	return d, nil
+}
+
+func (o *oidc) getJSON(u string, v interface{}) error {
+	resp, err := o.client.Get(u)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s: status %d", u, resp.StatusCode)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// key finds the signing key kid, refreshing the key set
+// when it's unknown (the provider rotated its keys)
+func (o *oidc) key(d *oidcDiscovery, kid string) (crypto.PublicKey, error) {
+	o.mut.Lock()
+	defer o.mut.Unlock()
+	if k, ok := o.keys[kid]; ok {
+		return k, nil
+	}
+	set := struct {
+		Keys []struct {
+			Kid string `json:"kid"`
+			Kty string `json:"kty"`
+			Crv string `json:"crv"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+			X   string `json:"x"`
+			Y   string `json:"y"`
+		} `json:"keys"`
+	}{}
+	if err := o.getJSON(d.JWKSURI, &set); err != nil {
+		return nil, fmt.Errorf("OIDC keys failed: %s", err)
+	}
+	o.keys = map[string]crypto.PublicKey{}
+	b64 := func(s string) *big.Int {
+		b, _ := base64.RawURLEncoding.DecodeString(s)
+		return new(big.Int).SetBytes(b)
+	}
+	for _, k := range set.Keys {
+		switch {
+		case k.Kty == "RSA":
+			o.keys[k.Kid] = &rsa.PublicKey{N: b64(k.N), E: int(b64(k.E).Int64())}
+		case k.Kty == "EC" && k.Crv == "P-256":
+			o.keys[k.Kid] = &ecdsa.PublicKey{Curve: elliptic.P256(), X: b64(k.X), Y: b64(k.Y)}
+		}
+	}
+	k, ok := o.keys[kid]
+	if !ok {
+		return nil, fmt.Errorf("Unknown OIDC key %q", kid)
+	}
+	return k, nil
+}
+
+// verify checks the id token's signature and
+// claims, and returns its claims
+func (o *oidc) verify(d *oidcDiscovery, clientID, idToken, nonce string) (map[string]interface{}, error) {
+	parts := strings.Split(idToken, ".")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("Malformed ID token")
+	}
+	header := struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}{}
+	if b, err := base64.RawURLEncoding.DecodeString(parts[0]); err != nil || json.Unmarshal(b, &header) != nil {
+		return nil, fmt.Errorf("Malformed ID token header")
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("Malformed ID token signature")
+	}
+	key, err := o.key(d, header.Kid)
+	if err != nil {
+		return nil, err
+	}
+	hash := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	valid := false
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		valid = header.Alg == "RS256" && rsa.VerifyPKCS1v15(k, crypto.SHA256, hash[:], sig) == nil
+	case *ecdsa.PublicKey:
+		valid = header.Alg == "ES256" && len(sig) == 64 &&
+			ecdsa.Verify(k, hash[:], new(big.Int).SetBytes(sig[:32]), new(big.Int).SetBytes(sig[32:]))
+	}
+	if !valid {
+		return nil, fmt.Errorf("Invalid ID token signature (%s)", header.Alg)
+	}
+	claims := map[string]interface{}{}
+	if b, err := base64.RawURLEncoding.DecodeString(parts[1]); err != nil || json.Unmarshal(b, &claims) != nil {
+		return nil, fmt.Errorf("Malformed ID token claims")
+	}
+	aud := false
+	switch a := claims["aud"].(type) {
+	case string:
+		aud = a == clientID
+	case []interface{}:
+		for _, v := range a {
+			aud = aud || v == clientID
+		}
+	}
+	exp, _ := claims["exp"].(float64)
+	switch {
+	case claims["iss"] != d.Issuer:
+		return nil, fmt.Errorf("Invalid ID token issuer")
+	case !aud:
+		return nil, fmt.Errorf("Invalid ID token audience")
+	case time.Now().After(time.Unix(int64(exp), 0)):
+		return nil, fmt.Errorf("Expired ID token")
+	case claims["nonce"] != nonce:
+		return nil, fmt.Errorf("Invalid ID token nonce")
+	}
+	return claims, nil
+}
+
+// oidcAuth signs users in with the OpenID Connect provider,
+// starting a session once the provider redirects back
+func (s *Server) oidcAuth(next http.Handler) (http.Handler, error) {
+	if s.OIDCClientID == "" {
+		return nil, fmt.Errorf("OIDC authentication requires a client ID")
+	}
+	o := &oidc{
+		issuer:  s.OIDCIssuer,
+		client:  &http.Client{Timeout: 15 * time.Second},
+		pending: map[string]*oidcPending{},
+	}
+	log.Printf("Enabled OIDC authentication (%s)", s.OIDCIssuer)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == oidcCallback {
+			s.oidcCallback(o, w, r)
+			return
+		}
+		if c, err := r.Cookie(sessionCookie); err == nil {
+			if u, ok := s.ssoUser(s.sessions.user(c.Value, r)); ok {
+				if u != nil {
+					r = withUser(r, u)
+				}
+				next.ServeHTTP(w, r)
+				return
+			}
+		}
+		//only page loads are sent to the provider
+		if r.Method != "GET" || strings.HasPrefix(r.URL.Path, "/api/") || r.URL.Path == "/sync" {
+			httpError(w, r, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		d, err := o.discover()
+		if err != nil {
+			log.Print(err)
+			http.Error(w, "Login unavailable", http.StatusBadGateway)
+			return
+		}
+		redirect := s.OIDCRedirectURL
+		if redirect == "" {
+			scheme := "http"
+			if r.TLS != nil {
+				scheme = "https"
+			}
+			redirect = scheme + "://" + r.Host + oidcCallback
+		}
+		returnTo := r.URL.RequestURI()
+		if !localPath(returnTo) {
+			returnTo = "/" //not another host
+		}
+		state := randomToken(16)
+		p := &oidcPending{
+			nonce:    randomToken(16),
+			verifier: randomToken(32),
+			redirect: redirect,
+			returnTo: returnTo,
+			expires:  time.Now().Add(oidcLogin),
+		}
+		o.mut.Lock()
+		for k, v := range o.pending {
+			if time.Now().After(v.expires) {
+				delete(o.pending, k)
+			}
+		}
+		o.pending[state] = p
+		o.mut.Unlock()
+		challenge := sha256.Sum256([]byte(p.verifier))
+		q := url.Values{}
+		q.Set("response_type", "code")
+		q.Set("client_id", s.OIDCClientID)
+		q.Set("redirect_uri", redirect)
+		q.Set("scope", "openid profile email")
+		q.Set("state", state)
+		q.Set("nonce", p.nonce)
+		q.Set("code_challenge", base64.RawURLEncoding.EncodeToString(challenge[:]))
+		q.Set("code_challenge_method", "S256")
+		sep := "?"
+		if strings.Contains(d.AuthEndpoint, "?") {
+			sep = "&"
+		}
+		http.Redirect(w, r, d.AuthEndpoint+sep+q.Encode(), http.StatusFound)
+	}), nil
+}
+
+// localPath reports whether p is a path on this host, browsers
+// treat "//host" and "/\host" as other hosts
+func localPath(p string) bool {
+	return strings.HasPrefix(p, "/") && (len(p) == 1 || (p[1] != '/' && p[1] != '\\'))
+}
+
+// oidcCallback exchanges the authorization code for
+// an id token, and starts a session for its user
+func (s *Server) oidcCallback(o *oidc, w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	o.mut.Lock()
+	p, ok := o.pending[q.Get("state")]
+	delete(o.pending, q.Get("state"))
+	o.mut.Unlock()
+	if !ok || time.Now().After(p.expires) {
+		http.Error(w, "Login expired, please try again", http.StatusBadRequest)
+		return
+	}
+	if e := q.Get("error"); e != "" {
+		http.Error(w, "Login failed: "+e+" "+q.Get("error_description"), http.StatusForbidden)
+		return
+	}
+	d, err := o.discover()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	form := url.Values{}
+	form.Set("grant_type", "authorization_code")
+	form.Set("code", q.Get("code"))
+	form.Set("redirect_uri", p.redirect)
+	form.Set("code_verifier", p.verifier)
+	req, _ := http.NewRequest("POST", d.TokenEndpoint, strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.SetBasicAuth(url.QueryEscape(s.OIDCClientID), url.QueryEscape(s.OIDCClientSecret))
+	resp, err := o.client.Do(req)
+	if err != nil {
+		http.Error(w, "Token exchange failed: "+err.Error(), http.StatusBadGateway)
+		return
+	}
+	defer resp.Body.Close()
+	tok := struct {
+		IDToken string `json:"id_token"`
+		Error   string `json:"error"`
+	}{}
+	if err := json.NewDecoder(resp.Body).Decode(&tok); err != nil || resp.StatusCode != http.StatusOK || tok.IDToken == "" {
+		http.Error(w, fmt.Sprintf("Token exchange failed: status %d %s", resp.StatusCode, tok.Error), http.StatusBadGateway)
+		return
+	}
+	claims, err := o.verify(d, s.OIDCClientID, tok.IDToken, p.nonce)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	name, _ := claims[s.OIDCUserClaim].(string)
+	if name == "" {
+		name, _ = claims["sub"].(string)
+	}
+	u, ok := s.ssoUser(name)
+	if !ok {
+		http.Error(w, "Unknown user "+name, http.StatusForbidden)
+		return
+	}
+	if u != nil {
+		r = withUser(r, u)
+	}
+	s.audit(r, "login", "oidc "+name, nil)
+	token, expires := s.sessions.create(name, r, nil)
+	setSessionCookie(w, r, token, expires)
+	http.Redirect(w, r, p.returnTo, http.StatusFound)
+}
@@ -0,0 +1,322 @@
+package server
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// mockOIDC is a minimal OpenID Connect provider, which
+// signs in "alice" with whatever the authorize request asks
+type mockOIDC struct {
+	*httptest.Server
+	t      *testing.T
+	mut    sync.Mutex
+	alg    string
+	kid    string
+	rsa    *rsa.PrivateKey
+	ec     *ecdsa.PrivateKey
+	forged bool //sign with a key other than the published one
+	claims func(map[string]interface{})
+	codes  map[string]url.Values
+	jwks   int
+}
+
+func newMockOIDC(t *testing.T, alg string) *mockOIDC {
+	m := &mockOIDC{t: t, alg: alg, codes: map[string]url.Values{}}
+	m.rotate()
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{
+			"issuer":                 m.URL,
+			"authorization_endpoint": m.URL + "/authorize",
+			"token_endpoint":         m.URL + "/token",
+			"jwks_uri":               m.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("/jwks", m.serveKeys)
+	mux.HandleFunc("/authorize", func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		code := randomToken(8)
+		m.mut.Lock()
+		m.codes[code] = q
+		m.mut.Unlock()
+		http.Redirect(w, r, q.Get("redirect_uri")+"?code="+code+"&state="+q.Get("state"), http.StatusFound)
+	})
+	mux.HandleFunc("/token", m.serveToken)
+	m.Server = httptest.NewServer(mux)
+	t.Cleanup(m.Close)
+	return m
+}
+
+// rotate replaces the signing key
+func (m *mockOIDC) rotate() {
+	m.mut.Lock()
+	defer m.mut.Unlock()
+	m.kid = randomToken(4)
+	var err error
+	if m.alg == "ES256" {
+		m.ec, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	} else {
+		m.rsa, err = rsa.GenerateKey(rand.Reader, 2048)
+	}
+	if err != nil {
+		m.t.Fatal(err)
+	}
+}
+
+func (m *mockOIDC) serveKeys(w http.ResponseWriter, r *http.Request) {
+	m.mut.Lock()
+	defer m.mut.Unlock()
+	m.jwks++
+	b64 := func(b []byte) string { return base64.RawURLEncoding.EncodeToString(b) }
+	k := map[string]string{"kid": m.kid}
+	if m.alg == "ES256" {
+		k["kty"], k["crv"] = "EC", "P-256"
+		k["x"] = b64(m.ec.X.FillBytes(make([]byte, 32)))
+		k["y"] = b64(m.ec.Y.FillBytes(make([]byte, 32)))
+	} else {
+		k["kty"] = "RSA"
+		k["n"] = b64(m.rsa.N.Bytes())
+		k["e"] = b64(big.NewInt(int64(m.rsa.E)).Bytes())
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{"keys": []interface{}{k}})
+}
+
+func (m *mockOIDC) serveToken(w http.ResponseWriter, r *http.Request) {
+	id, secret, _ := r.BasicAuth()
+	m.mut.Lock()
+	q, ok := m.codes[r.FormValue("code")]
+	delete(m.codes, r.FormValue("code"))
+	m.mut.Unlock()
+	challenge := sha256.Sum256([]byte(r.FormValue("code_verifier")))
+	switch {
+	case id != "ct" || secret != "secret":
+		http.Error(w, `{"error":"invalid_client"}`, http.StatusUnauthorized)
+		return
+	case !ok || r.FormValue("redirect_uri") != q.Get("redirect_uri"):
+		http.Error(w, `{"error":"invalid_grant"}`, http.StatusBadRequest)
+		return
+	case base64.RawURLEncoding.EncodeToString(challenge[:]) != q.Get("code_challenge"):
+		http.Error(w, `{"error":"invalid_grant","error_description":"pkce"}`, http.StatusBadRequest)
+		return
+	}
+	claims := map[string]interface{}{
+		"iss":                m.URL,
+		"sub":                "1234",
+		"aud":                q.Get("client_id"),
+		"exp":                time.Now().Add(time.Hour).Unix(),
+		"iat":                time.Now().Unix(),
+		"nonce":              q.Get("nonce"),
+		"preferred_username": "alice",
+	}
+	if m.claims != nil {
+		m.claims(claims)
+	}
+	json.NewEncoder(w).Encode(map[string]string{"id_token": m.sign(claims)})
+}
+
+func (m *mockOIDC) sign(claims map[string]interface{}) string {
+	m.mut.Lock()
+	defer m.mut.Unlock()
+	enc := func(v interface{}) string {
+		b, _ := json.Marshal(v)
+		return base64.RawURLEncoding.EncodeToString(b)
+	}
+	signed := enc(map[string]string{"alg": m.alg, "kid": m.kid, "typ": "JWT"}) + "." + enc(claims)
+	hash := sha256.Sum256([]byte(signed))
+	var sig []byte
+	var err error
+	if m.alg == "ES256" {
+		key := m.ec
+		if m.forged {
+			key, _ = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		}
+		var r, s *big.Int
+		r, s, err = ecdsa.Sign(rand.Reader, key, hash[:])
+		if err == nil {
+			sig = append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...)
+		}
+	} else {
+		key := m.rsa
+		if m.forged {
+			key, _ = rsa.GenerateKey(rand.Reader, 2048)
+		}
+		sig, err = rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, hash[:])
+	}
+	if err != nil {
+		m.t.Fatal(err)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+func newOIDCServer(t *testing.T, m *mockOIDC) http.Handler {
+	s := &Server{
+		OIDCIssuer:       m.URL,
+		OIDCClientID:     "ct",
+		OIDCClientSecret: "secret",
+		OIDCUserClaim:    "preferred_username",
+	}
+	h, err := s.oidcAuth(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return h
+}
+
+// signIn loads path, follows the provider's redirects,
+// and returns the callback's response
+func signIn(t *testing.T, h http.Handler, path string) *httptest.ResponseRecorder {
+	t.Helper()
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+	if w.Code != http.StatusFound {
+		t.Fatalf("expected login redirect, got %d %s", w.Code, w.Body)
+	}
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}}
+	resp, err := client.Get(w.Header().Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	callback, err := url.Parse(resp.Header.Get("Location"))
+	if err != nil || callback.Path != oidcCallback {
+		t.Fatalf("expected callback redirect, got %q", resp.Header.Get("Location"))
+	}
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", callback.RequestURI(), nil))
+	return w
+}
+
+func TestOIDCLogin(t *testing.T) {
+	for _, alg := range []string{"RS256", "ES256"} {
+		t.Run(alg, func(t *testing.T) {
+			h := newOIDCServer(t, newMockOIDC(t, alg))
+			w := signIn(t, h, "/downloads/?x=1")
+			if w.Code != http.StatusFound || w.Header().Get("Location") != "/downloads/?x=1" {
+				t.Fatalf("expected return redirect, got %d %q %s", w.Code, w.Header().Get("Location"), w.Body)
+			}
+			cookies := w.Result().Cookies()
+			if len(cookies) == 0 || cookies[0].Name != sessionCookie {
+				t.Fatal("expected a session cookie")
+			}
+			r := httptest.NewRequest("GET", "/api/torrents", nil)
+			r.AddCookie(cookies[0])
+			w = httptest.NewRecorder()
+			h.ServeHTTP(w, r)
+			if w.Code != http.StatusOK || w.Body.String() != "ok" {
+				t.Fatalf("expected session to be accepted, got %d %s", w.Code, w.Body)
+			}
+		})
+	}
+}
+
+func TestOIDCUnauthenticatedAPI(t *testing.T) {
+	h := newOIDCServer(t, newMockOIDC(t, "RS256"))
+	for _, r := range []*http.Request{
+		httptest.NewRequest("GET", "/api/torrents", nil),
+		httptest.NewRequest("GET", "/sync", nil),
+		httptest.NewRequest("POST", "/", nil),
+	} {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if w.Code != http.StatusUnauthorized {
+			t.Fatalf("%s %s: expected 401, got %d", r.Method, r.URL, w.Code)
+		}
+	}
+}
+
+func TestOIDCRejectsTokens(t *testing.T) {
+	for name, claims := range map[string]func(map[string]interface{}){
+		"audience": func(c map[string]interface{}) { c["aud"] = "other" },
+		"issuer":   func(c map[string]interface{}) { c["iss"] = "https://evil.example" },
+		"expired":  func(c map[string]interface{}) { c["exp"] = time.Now().Add(-time.Minute).Unix() },
+		"nonce":    func(c map[string]interface{}) { c["nonce"] = "replayed" },
+	} {
+		t.Run(name, func(t *testing.T) {
+			m := newMockOIDC(t, "RS256")
+			m.claims = claims
+			w := signIn(t, newOIDCServer(t, m), "/")
+			if w.Code != http.StatusForbidden || len(w.Result().Cookies()) > 0 {
+				t.Fatalf("expected 403 without session, got %d %s", w.Code, w.Body)
+			}
+		})
+	}
+	for _, alg := range []string{"RS256", "ES256"} {
+		t.Run("signature "+alg, func(t *testing.T) {
+			m := newMockOIDC(t, alg)
+			m.forged = true
+			w := signIn(t, newOIDCServer(t, m), "/")
+			if w.Code != http.StatusForbidden || !strings.Contains(w.Body.String(), "signature") {
+				t.Fatalf("expected signature error, got %d %s", w.Code, w.Body)
+			}
+		})
+	}
+	t.Run("aud list", func(t *testing.T) {
+		m := newMockOIDC(t, "RS256")
+		m.claims = func(c map[string]interface{}) { c["aud"] = []string{"other", "ct"} }
+		if w := signIn(t, newOIDCServer(t, m), "/"); w.Code != http.StatusFound {
+			t.Fatalf("expected audience list to be accepted, got %d %s", w.Code, w.Body)
+		}
+	})
+}
+
+func TestOIDCKeyRotation(t *testing.T) {
+	m := newMockOIDC(t, "RS256")
+	h := newOIDCServer(t, m)
+	for i := 0; i < 2; i++ {
+		if w := signIn(t, h, "/"); w.Code != http.StatusFound {
+			t.Fatalf("login %d failed: %d %s", i, w.Code, w.Body)
+		}
+	}
+	if m.jwks != 1 {
+		t.Fatalf("expected cached keys, fetched %d times", m.jwks)
+	}
+	m.rotate()
+	if w := signIn(t, h, "/"); w.Code != http.StatusFound {
+		t.Fatalf("login after rotation failed: %d %s", w.Code, w.Body)
+	}
+	if m.jwks != 2 {
+		t.Fatalf("expected keys to be refreshed, fetched %d times", m.jwks)
+	}
+}
+
+func TestOIDCReturnTo(t *testing.T) {
+	h := newOIDCServer(t, newMockOIDC(t, "RS256"))
+	for _, p := range []string{"//evil.example/x", `/\evil.example/x`, `/%5Cevil.example`} {
+		w := signIn(t, h, p)
+		if loc := w.Header().Get("Location"); w.Code != http.StatusFound || !localPath(loc) {
+			t.Fatalf("%s: expected a local redirect, got %d %q", p, w.Code, loc)
+		}
+	}
+	for p, local := range map[string]bool{
+		"/":         true,
+		"/a/b?c=d":  true,
+		"//evil":    false,
+		`/\evil`:    false,
+		"evil":      false,
+		"https://x": false,
+		"":          false,
+	} {
+		if localPath(p) != local {
+			t.Fatalf("localPath(%q) != %v", p, local)
+		}
+	}
+}
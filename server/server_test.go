@@ -0,0 +1,87 @@
+package server
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/anacrolix/torrent/bencode"
+	"github.com/anacrolix/torrent/metainfo"
+	"github.com/jpillora/cloud-torrent/engine"
+)
+
+// newTestServer is a server with a running engine, as Run
+// sets it up, without listening. withUsers enables the
+// multi-user store, with the admin "admin".
+func newTestServer(t *testing.T, withUsers bool) *Server {
+	t.Helper()
+	dir := t.TempDir()
+	s := &Server{
+		Title:      "Test",
+		ConfigPath: filepath.Join(dir, "config.json"),
+		TokensPath: filepath.Join(dir, "tokens.json"),
+		SharesPath: filepath.Join(dir, "shares.json"),
+	}
+	if withUsers {
+		s.UsersPath = filepath.Join(dir, "users.json")
+		s.Auth = "admin:password"
+		if err := s.initUsers(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	s.state.Users = map[string]*userConn{}
+	s.csrfSecret = []byte(randomToken(32))
+	s.engine = engine.New()
+	s.client = &http.Client{}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := l.Addr().(*net.TCPAddr).Port
+	l.Close()
+	c := engine.Config{
+		DownloadDirectory: filepath.Join(dir, "downloads"),
+		IncomingPort:      port,
+		ListenAddress:     "127.0.0.1",
+		Storage:           engine.StorageFile,
+		DisableDHT:        true,
+		DisableUTP:        true,
+	}
+	if err := os.MkdirAll(c.DownloadDirectory, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.reconfigure(c); err != nil {
+		t.Fatal(err)
+	}
+	if s.tokens, err = loadTokens(s.TokensPath); err != nil {
+		t.Fatal(err)
+	}
+	if s.shares, err = loadShares(s.SharesPath); err != nil {
+		t.Fatal(err)
+	}
+	s.v1 = s.v1Handler()
+	return s
+}
+
+// testTorrent is a .torrent file of the single file
+// hello.txt, with its infohash
+func testTorrent(t *testing.T) (string, []byte) {
+	t.Helper()
+	data := []byte("hello")
+	sum := sha1.Sum(data)
+	info := metainfo.Info{Name: "hello.txt", PieceLength: 16 << 10, Length: int64(len(data)), Pieces: sum[:]}
+	infoBytes, err := bencode.Marshal(info)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mi := metainfo.MetaInfo{InfoBytes: infoBytes}
+	buf := bytes.Buffer{}
+	if err := mi.Write(&buf); err != nil {
+		t.Fatal(err)
+	}
+	return mi.HashInfoBytes().HexString(), buf.Bytes()
+}
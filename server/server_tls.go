@@ -0,0 +1,121 @@
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const certPollInterval = 10 * time.Second
+
+// certReloader serves the certificate at certPath/keyPath,
+// reloading it when the files change or on SIGHUP
+type certReloader struct {
+	mut      sync.RWMutex
+	certPath string
+	keyPath  string
+	cert     *tls.Certificate
+	modified string
+}
+
+func loadCerts(certPath, keyPath string) (*certReloader, error) {
+	c := &certReloader{certPath: certPath, keyPath: keyPath}
+	if err := c.reload(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// stamp identifies the current version of the files
+func (c *certReloader) stamp() string {
+	stamp := ""
+	for _, p := range []string{c.certPath, c.keyPath} {
+		if info, err := os.Stat(p); err == nil {
+			stamp += fmt.Sprintf("%d:%d,", info.ModTime().UnixNano(), info.Size())
+		}
+	}
+	return stamp
+}
+
+func (c *certReloader) reload() error {
+	stamp := c.stamp()
+	cert, err := tls.LoadX509KeyPair(c.certPath, c.keyPath)
+	if err != nil {
+		return fmt.Errorf("Load TLS certificate error: %s", err)
+	}
+	c.mut.Lock()
+	c.cert = &cert
+	c.modified = stamp
+	c.mut.Unlock()
+	return nil
+}
+
+// watch polls the files for changes, and listens for SIGHUP.
+// a bad certificate is logged and the previous one kept.
+func (c *certReloader) watch() {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	poll := time.NewTicker(certPollInterval)
+	for {
+		select {
+		case <-hup:
+		case <-poll.C:
+			c.mut.RLock()
+			modified := c.modified
+			c.mut.RUnlock()
+			if c.stamp() == modified {
+				continue
+			}
+		}
+		if err := c.reload(); err != nil {
+			log.Print(err)
+		} else {
+			log.Printf("Reloaded TLS certificate (%s)", c.certPath)
+		}
+	}
+}
+
+func (c *certReloader) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.mut.RLock()
+	defer c.mut.RUnlock()
+	return c.cert, nil
+}
+
+// loadClientCAs reads the PEM bundle of CAs
+// which may sign client certificates
+func loadClientCAs(path string) (*x509.CertPool, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("Read client CA error: %s", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(b) {
+		return nil, fmt.Errorf("Invalid client CA (expecting PEM)")
+	}
+	return pool, nil
+}
+
+// clientCerts requires a verified client certificate for api
+// requests (including the web ui's and its realtime sync) and
+// any other changes, reading pages and downloads is left to
+// the login
+func (s *Server) clientCerts(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		p := r.URL.Path
+		read := r.Method == "GET" || r.Method == "HEAD"
+		api := strings.HasPrefix(p, "/api/") || p == "/transmission/rpc" || p == "/sync"
+		if (api || !read) && (r.TLS == nil || len(r.TLS.VerifiedChains) == 0) {
+			httpError(w, r, "Client certificate required", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,42 @@
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestClientCerts(t *testing.T) {
+	s := &Server{}
+	h := s.clientCerts(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	for _, c := range []struct {
+		method, path string
+		required     bool
+	}{
+		{"GET", "/", false},
+		{"GET", "/download/file.txt", false},
+		{"HEAD", "/download/file.txt", false},
+		{"DELETE", "/download/file.txt", true},
+		{"POST", "/download/file.txt", true},
+		{"GET", "/sync", true},
+		{"GET", "/api/v1/torrents", true},
+		{"POST", "/api/magnet", true},
+		{"POST", "/transmission/rpc", true},
+		{"POST", "/search", true},
+	} {
+		for _, verified := range []bool{false, true} {
+			r := httptest.NewRequest(c.method, c.path, nil)
+			r.TLS = &tls.ConnectionState{}
+			if verified {
+				r.TLS.VerifiedChains = [][]*x509.Certificate{{{}}}
+			}
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, r)
+			if expected := c.required && !verified; (w.Code == http.StatusForbidden) != expected {
+				t.Fatalf("%s %s (verified %v): got %d", c.method, c.path, verified, w.Code)
+			}
+		}
+	}
+}
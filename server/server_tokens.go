@@ -0,0 +1,339 @@
+package server
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// token scopes, checked in addition to the owner's role
+const (
+	scopeRead     = "read"     //viewer requests to /api/
+	scopeWrite    = "write"    //operator requests to /api/, deleting downloads
+	scopeDownload = "download" //fetching /download/ files
+	scopeAdmin    = "admin"    //admin requests to /api/, managing tokens
+)
+
+// scopeRoles are the roles required to grant each scope
+var scopeRoles = map[string]string{
+	scopeRead:     roleViewer,
+	scopeWrite:    roleOperator,
+	scopeDownload: roleViewer,
+	scopeAdmin:    roleAdmin,
+}
+
+const tokenPrefix = "ct_"
+
+// apiToken is a long-lived bearer token, only
+// the sha256 hash of the secret is stored
+type apiToken struct {
+	ID       string     `json:"id"`
+	Name     string     `json:"name"`
+	User     string     `json:"user,omitempty"`
+	Scopes   []string   `json:"scopes"`
+	Hash     string     `json:"hash,omitempty"`
+	Created  time.Time  `json:"created"`
+	Expires  *time.Time `json:"expires,omitempty"`
+	LastUsed *time.Time `json:"lastUsed,omitempty"`
+}
+
+func (t *apiToken) has(scope string) bool {
+	for _, s := range t.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// tokens is the token store, persisted as json
+type tokens struct {
+	mut    sync.Mutex
+	path   string
+	tokens map[string]*apiToken //by hash
+	//when last uses were last saved
+	usesSaved time.Time
+}
+
+func loadTokens(path string) (*tokens, error) {
+	ts := &tokens{path: path, tokens: map[string]*apiToken{}}
+	b, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return ts, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("Read tokens error: %s", err)
+	}
+	list := []*apiToken{}
+	if len(b) > 0 {
+		if err := json.Unmarshal(b, &list); err != nil {
+			return nil, fmt.Errorf("Malformed tokens file: %s", err)
+		}
+	}
+	for _, t := range list {
+		ts.tokens[t.Hash] = t
+	}
+	return ts, nil
+}
+
+// save writes the store atomically, must hold the lock
+func (ts *tokens) save() error {
+	b, _ := json.MarshalIndent(ts.sorted(true), "", "  ")
+	tmp := ts.path + ".tmp"
+	if err := os.WriteFile(tmp, b, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, ts.path)
+}
+
+// sorted lists the tokens by creation, must hold the lock
+func (ts *tokens) sorted(hashes bool) []*apiToken {
+	list := []*apiToken{}
+	for _, t := range ts.tokens {
+		c := *t
+		if !hashes {
+			c.Hash = ""
+		}
+		list = append(list, &c)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Created.Before(list[j].Created)
+	})
+	return list
+}
+
+func hashToken(secret string) string {
+	h := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(h[:])
+}
+
+// create a token, returning it along with its secret
+func (ts *tokens) create(t apiToken) (*apiToken, string, error) {
+	secret := tokenPrefix + randomToken(24)
+	t.ID = randomToken(4)
+	t.Hash = hashToken(secret)
+	t.Created = time.Now().UTC()
+	ts.mut.Lock()
+	defer ts.mut.Unlock()
+	ts.tokens[t.Hash] = &t
+	if err := ts.save(); err != nil {
+		delete(ts.tokens, t.Hash)
+		return nil, "", fmt.Errorf("Save tokens error: %s", err)
+	}
+	c := t
+	c.Hash = ""
+	return &c, secret, nil
+}
+
+// verify returns a copy of the unexpired token with the given secret
+func (ts *tokens) verify(secret string) *apiToken {
+	if !strings.HasPrefix(secret, tokenPrefix) {
+		return nil
+	}
+	ts.mut.Lock()
+	defer ts.mut.Unlock()
+	t, ok := ts.tokens[hashToken(secret)]
+	if !ok {
+		return nil
+	}
+	now := time.Now().UTC()
+	if t.Expires != nil && now.After(*t.Expires) {
+		return nil
+	}
+	//last uses are saved at most once a minute
+	t.LastUsed = &now
+	if now.Sub(ts.usesSaved) > time.Minute {
+		ts.usesSaved = now
+		if err := ts.save(); err != nil {
+			log.Printf("Save tokens error: %s", err)
+		}
+	}
+	c := *t
+	return &c
+}
+
+// list the tokens of user, or all tokens when all is set
+func (ts *tokens) list(user string, all bool) []*apiToken {
+	ts.mut.Lock()
+	defer ts.mut.Unlock()
+	list := []*apiToken{}
+	for _, t := range ts.sorted(false) {
+		if all || t.User == user {
+			list = append(list, t)
+		}
+	}
+	return list
+}
+
+// get the token with the given id
+func (ts *tokens) get(id string) *apiToken {
+	ts.mut.Lock()
+	defer ts.mut.Unlock()
+	for _, t := range ts.sorted(false) {
+		if t.ID == id {
+			return t
+		}
+	}
+	return nil
+}
+
+func (ts *tokens) revoke(id string) error {
+	ts.mut.Lock()
+	defer ts.mut.Unlock()
+	for hash, t := range ts.tokens {
+		if t.ID == id {
+			delete(ts.tokens, hash)
+			if err := ts.save(); err != nil {
+				ts.tokens[hash] = t
+				return fmt.Errorf("Save tokens error: %s", err)
+			}
+			return nil
+		}
+	}
+	return fmt.Errorf("Missing token %s", id)
+}
+
+type tokenKey struct{}
+
+// requestToken is the api token of a request, nil
+// when it was authenticated otherwise
+func requestToken(r *http.Request) *apiToken {
+	t, _ := r.Context().Value(tokenKey{}).(*apiToken)
+	return t
+}
+
+// tokenScope is the scope a token needs for the request
+func tokenScope(r *http.Request) string {
+	p := r.URL.Path
+	read := r.Method == "GET" || r.Method == "HEAD"
+	switch {
+	case strings.HasPrefix(p, "/download/"):
+		if read {
+			return scopeDownload
+		}
+		return scopeWrite
+	case p == v1Prefix+"/tokens" || strings.HasPrefix(p, v1Prefix+"/tokens/"),
+		p == v1Prefix+"/sessions" || strings.HasPrefix(p, v1Prefix+"/sessions/"):
+		return scopeAdmin
+	}
+	switch requiredRole(r) {
+	case roleAdmin:
+		return scopeAdmin
+	case roleOperator:
+		return scopeWrite
+	}
+	return scopeRead
+}
+
+// bearer authenticates "Authorization: Bearer" requests to
+// /api/ and /download/ with api tokens, bypassing the login.
+// other requests are passed to login.
+func (s *Server) bearer(next, login http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth := r.Header.Get("Authorization")
+		p := r.URL.Path
+		if !strings.HasPrefix(auth, "Bearer ") ||
+			!(strings.HasPrefix(p, "/api/") || strings.HasPrefix(p, "/download/")) {
+			login.ServeHTTP(w, r)
+			return
+		}
+		t := s.tokens.verify(strings.TrimPrefix(auth, "Bearer "))
+		if t == nil {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="Cloud Torrent"`)
+			httpError(w, r, "Invalid token", http.StatusUnauthorized)
+			return
+		}
+		if s.users != nil {
+			u := s.users.get(t.User)
+			if u == nil {
+				httpError(w, r, "Invalid token", http.StatusUnauthorized)
+				return
+			}
+			r = withUser(r, u)
+		}
+		r = r.WithContext(context.WithValue(r.Context(), tokenKey{}, t))
+		if scope := tokenScope(r); !t.has(scope) {
+			httpError(w, r, "Forbidden ("+scope+" scope required)", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// tokenRequest creates a token
+type tokenRequest struct {
+	Name    string     `json:"name"`
+	Scopes  []string   `json:"scopes"`
+	Expires *time.Time `json:"expires"`
+}
+
+func (s *Server) v1ListTokens(w http.ResponseWriter, r *http.Request) {
+	v1Write(w, http.StatusOK, s.tokens.list(s.owner(r), s.seesAll(r)))
+}
+
+func (s *Server) v1CreateToken(w http.ResponseWriter, r *http.Request) {
+	req := tokenRequest{}
+	if !v1Read(w, r, &req) {
+		return
+	}
+	if req.Name == "" {
+		v1Fail(w, http.StatusBadRequest, fmt.Errorf("Missing token name"))
+		return
+	}
+	if len(req.Scopes) == 0 {
+		v1Fail(w, http.StatusBadRequest, fmt.Errorf("Missing token scopes"))
+		return
+	}
+	for _, scope := range req.Scopes {
+		role, ok := scopeRoles[scope]
+		if !ok {
+			v1Fail(w, http.StatusBadRequest, fmt.Errorf("Invalid scope %q (read, write, download or admin)", scope))
+			return
+		}
+		if !s.can(r, role) {
+			v1Fail(w, http.StatusForbidden, fmt.Errorf("Scope %s requires the %s role", scope, role))
+			return
+		}
+	}
+	if req.Expires != nil && req.Expires.Before(time.Now()) {
+		v1Fail(w, http.StatusBadRequest, fmt.Errorf("Token expiry is in the past"))
+		return
+	}
+	t, secret, err := s.tokens.create(apiToken{
+		Name:    req.Name,
+		User:    s.owner(r),
+		Scopes:  req.Scopes,
+		Expires: req.Expires,
+	})
+	if err != nil {
+		v1Fail(w, http.StatusInternalServerError, err)
+		return
+	}
+	//the secret is only ever shown here
+	v1Write(w, http.StatusCreated, struct {
+		*apiToken
+		Token string `json:"token"`
+	}{t, secret})
+}
+
+func (s *Server) v1RevokeToken(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	t := s.tokens.get(id)
+	if t == nil || !(s.seesAll(r) || t.User == s.owner(r)) {
+		v1Fail(w, http.StatusNotFound, fmt.Errorf("Missing token %s", id))
+		return
+	}
+	if err := s.tokens.revoke(id); err != nil {
+		v1Fail(w, http.StatusInternalServerError, err)
+		return
+	}
+	v1Write(w, http.StatusNoContent, nil)
+}
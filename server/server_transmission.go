@@ -0,0 +1,518 @@
+package server
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/jpillora/cloud-torrent/engine"
+	"github.com/shirou/gopsutil/v3/disk"
+)
+
+// Transmission RPC compatibility, see
+// https://github.com/transmission/transmission/blob/main/docs/rpc-spec.md
+
+const (
+	trSessionHeader = "X-Transmission-Session-Id"
+	trRPCVersion    = 17
+)
+
+// transmission holds the rpc session id and the integer
+// torrent ids which transmission clients expect
+type transmission struct {
+	mut     sync.Mutex
+	session string
+	ids     map[string]int
+	hashes  map[int]string
+}
+
+func (tr *transmission) sessionID() string {
+	tr.mut.Lock()
+	defer tr.mut.Unlock()
+	if tr.session == "" {
+		b := make([]byte, 24)
+		rand.Read(b)
+		tr.session = hex.EncodeToString(b)
+	}
+	return tr.session
+}
+
+// id returns the stable integer id of an infohash
+func (tr *transmission) id(infohash string) int {
+	tr.mut.Lock()
+	defer tr.mut.Unlock()
+	if tr.ids == nil {
+		tr.ids = map[string]int{}
+		tr.hashes = map[int]string{}
+	}
+	id, ok := tr.ids[infohash]
+	if !ok {
+		id = len(tr.ids) + 1
+		tr.ids[infohash] = id
+		tr.hashes[id] = infohash
+	}
+	return id
+}
+
+func (tr *transmission) hash(id int) string {
+	tr.mut.Lock()
+	defer tr.mut.Unlock()
+	return tr.hashes[id]
+}
+
+type trRequest struct {
+	Method    string          `json:"method"`
+	Arguments json.RawMessage `json:"arguments"`
+	Tag       *int            `json:"tag,omitempty"`
+}
+
+type trResponse struct {
+	Result    string      `json:"result"`
+	Arguments interface{} `json:"arguments"`
+	Tag       *int        `json:"tag,omitempty"`
+}
+
+// trArgs are the union of all supported method arguments
+type trArgs struct {
+	IDs              json.RawMessage `json:"ids"`
+	Fields           []string        `json:"fields"`
+	Filename         string          `json:"filename"`
+	Metainfo         string          `json:"metainfo"`
+	DownloadDir      *string         `json:"download-dir"`
+	Paused           bool            `json:"paused"`
+	Labels           *[]string       `json:"labels"`
+	DeleteLocalData  bool            `json:"delete-local-data"`
+	PeerLimit        *int            `json:"peer-limit"`
+	Path             string          `json:"path"`
+	PeerPort         *int            `json:"peer-port"`
+	DHTEnabled       *bool           `json:"dht-enabled"`
+	PEXEnabled       *bool           `json:"pex-enabled"`
+	UTPEnabled       *bool           `json:"utp-enabled"`
+	LPDEnabled       *bool           `json:"lpd-enabled"`
+	PeerLimitPerTorr *int            `json:"peer-limit-per-torrent"`
+	Cookies          string          `json:"cookies"`
+}
+
+func (s *Server) serveTransmission(w http.ResponseWriter, r *http.Request) {
+	session := s.transmission.sessionID()
+	w.Header().Set(trSessionHeader, session)
+	if r.Header.Get(trSessionHeader) != session {
+		w.WriteHeader(http.StatusConflict)
+		w.Write([]byte("<h1>409: Conflict</h1><p>Invalid session-id header</p><p><code>" + trSessionHeader + ": " + session + "</code></p>"))
+		return
+	}
+	if r.Method != "POST" {
+		http.Error(w, "Not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	req := trRequest{}
+	if err := json.NewDecoder(io.LimitReader(r.Body, 20<<20)).Decode(&req); err != nil {
+		http.Error(w, "Invalid request: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	args := trArgs{}
+	if len(req.Arguments) > 0 {
+		if err := json.Unmarshal(req.Arguments, &args); err != nil {
+			http.Error(w, "Invalid arguments: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	resp := trResponse{Result: "success", Arguments: struct{}{}, Tag: req.Tag}
+	if role := trRole(req.Method); !s.can(r, role) {
+		resp.Result = "forbidden (" + role + " role required)"
+	} else if result, err := s.transmissionCall(r, req.Method, &args); err != nil {
+		resp.Result = err.Error()
+	} else if result != nil {
+		resp.Arguments = result
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(&resp)
+}
+
+// trMutating reports whether the rpc request body changes state
+func trMutating(body string) bool {
+	req := struct {
+		Method string `json:"method"`
+	}{}
+	json.Unmarshal([]byte(body), &req)
+	return trRole(req.Method) != roleViewer
+}
+
+// trRole is the user role required by an rpc method
+func trRole(method string) string {
+	switch method {
+	case "session-get", "session-stats", "torrent-get", "free-space":
+		return roleViewer
+	case "session-set":
+		return roleAdmin
+	}
+	return roleOperator
+}
+
+func (s *Server) transmissionCall(r *http.Request, method string, args *trArgs) (interface{}, error) {
+	switch method {
+	case "session-get":
+		return s.trSession(r), nil
+	case "session-set":
+		return nil, s.trSessionSet(r, args)
+	case "session-stats":
+		return s.trSessionStats(r), nil
+	case "free-space":
+		return s.trFreeSpace(r, args.Path)
+	case "torrent-get":
+		ts, err := s.trTorrents(r, args.IDs)
+		if err != nil {
+			return nil, err
+		}
+		list := []map[string]interface{}{}
+		for _, t := range ts {
+			list = append(list, s.trTorrent(t, args.Fields))
+		}
+		return map[string]interface{}{"torrents": list, "removed": []int{}}, nil
+	case "torrent-add":
+		return s.trAdd(r, args)
+	case "torrent-start", "torrent-start-now", "torrent-stop", "torrent-remove", "torrent-verify", "torrent-set":
+		ts, err := s.trTorrents(r, args.IDs)
+		if err != nil {
+			return nil, err
+		}
+		defer s.state.Push()
+		for _, t := range ts {
+			if err := s.trAction(method, t, args); err != nil {
+				return nil, err
+			}
+		}
+		return nil, nil
+	}
+	return nil, fmt.Errorf("method name not recognized")
+}
+
+func (s *Server) trAction(method string, t *engine.Torrent, args *trArgs) error {
+	switch method {
+	case "torrent-start", "torrent-start-now":
+		if !t.Started {
+			return s.engine.StartTorrent(t.InfoHash)
+		}
+	case "torrent-stop":
+		if t.Started {
+			return s.engine.StopTorrent(t.InfoHash)
+		}
+	case "torrent-remove":
+		if args.DeleteLocalData {
+			return s.engine.DeleteTorrentData(t.InfoHash)
+		}
+		return s.engine.DeleteTorrent(t.InfoHash)
+	case "torrent-verify":
+		return s.engine.RecheckTorrent(t.InfoHash)
+	case "torrent-set":
+		if args.Labels != nil {
+			if err := s.engine.SetLabels(t.InfoHash, *args.Labels); err != nil {
+				return err
+			}
+		}
+		if args.PeerLimit != nil {
+			return s.engine.SetMaxConns(t.InfoHash, *args.PeerLimit)
+		}
+	}
+	return nil
+}
+
+// trTorrents resolves the "ids" argument: absent (all torrents),
+// a single id, or a list of ids and hash strings, of the user's torrents
+func (s *Server) trTorrents(r *http.Request, raw json.RawMessage) ([]*engine.Torrent, error) {
+	s.state.Lock()
+	s.state.Torrents = s.engine.GetTorrents()
+	all := []*engine.Torrent{}
+	for _, t := range s.state.Torrents {
+		if s.owns(r, t) {
+			all = append(all, t)
+		}
+	}
+	s.state.Unlock()
+	//new torrents are numbered in infohash order
+	sort.Slice(all, func(i, j int) bool {
+		return all[i].InfoHash < all[j].InfoHash
+	})
+	for _, t := range all {
+		s.transmission.id(t.InfoHash)
+	}
+	sort.Slice(all, func(i, j int) bool {
+		return s.transmission.id(all[i].InfoHash) < s.transmission.id(all[j].InfoHash)
+	})
+	var ids []interface{}
+	if len(raw) > 0 {
+		var v interface{}
+		if err := json.Unmarshal(raw, &v); err != nil {
+			return nil, fmt.Errorf("invalid ids")
+		}
+		switch v := v.(type) {
+		case []interface{}:
+			ids = v
+		case string:
+			//"recently-active", all torrents are considered active
+			if v != "recently-active" {
+				ids = []interface{}{v}
+			}
+		default:
+			ids = []interface{}{v}
+		}
+	}
+	if ids == nil {
+		return all, nil
+	}
+	want := map[string]bool{}
+	for _, id := range ids {
+		switch id := id.(type) {
+		case float64:
+			want[s.transmission.hash(int(id))] = true
+		case string:
+			want[strings.ToLower(id)] = true
+		}
+	}
+	ts := []*engine.Torrent{}
+	for _, t := range all {
+		if want[t.InfoHash] {
+			ts = append(ts, t)
+		}
+	}
+	return ts, nil
+}
+
+// trTorrent builds the requested fields of a torrent
+func (s *Server) trTorrent(t *engine.Torrent, fields []string) map[string]interface{} {
+	c := s.engine.Config()
+	left := t.Size - t.Downloaded
+	if left < 0 {
+		left = 0
+	}
+	status := 0
+	if t.Started {
+		status = 4
+		if t.Loaded && left == 0 {
+			status = 6
+		}
+	}
+	eta := -1
+	if t.DownloadRate > 0 && left > 0 {
+		eta = int(float32(left) / t.DownloadRate)
+	}
+	labels := t.Labels
+	if labels == nil {
+		labels = []string{}
+	}
+	files := []map[string]interface{}{}
+	fileStats := []map[string]interface{}{}
+	for _, f := range t.Files {
+		done := int64(0)
+		if f.Chunks > 0 {
+			done = f.Size * int64(f.Completed) / int64(f.Chunks)
+		}
+		files = append(files, map[string]interface{}{
+			"name": f.Path, "length": f.Size, "bytesCompleted": done,
+		})
+		fileStats = append(fileStats, map[string]interface{}{
+			"bytesCompleted": done, "wanted": f.Started || !t.Started, "priority": 0,
+		})
+	}
+	all := map[string]interface{}{
+		"id":                      s.transmission.id(t.InfoHash),
+		"hashString":              t.InfoHash,
+		"name":                    t.Name,
+		"totalSize":               t.Size,
+		"sizeWhenDone":            t.Size,
+		"leftUntilDone":           left,
+		"percentDone":             t.Percent / 100,
+		"downloadedEver":          t.Downloaded,
+		"uploadedEver":            0,
+		"uploadRatio":             0,
+		"rateDownload":            int(t.DownloadRate),
+		"rateUpload":              0,
+		"status":                  status,
+		"error":                   0,
+		"errorString":             "",
+		"eta":                     eta,
+		"isFinished":              t.Loaded && left == 0,
+		"isPrivate":               t.Private,
+		"labels":                  labels,
+		"downloadDir":             filepath.Join(c.DownloadDirectory, t.SavePath),
+		"metadataPercentComplete": map[bool]int{true: 1, false: 0}[t.Loaded],
+		"magnetLink":              "magnet:?xt=urn:btih:" + t.InfoHash,
+		"queuePosition":           0,
+		"peer-limit":              t.MaxConns,
+		"seedRatioLimit":          0,
+		"seedRatioMode":           0,
+		"files":                   files,
+		"fileStats":               fileStats,
+		"webseeds":                t.WebSeeds,
+	}
+	if len(fields) == 0 {
+		return all
+	}
+	m := map[string]interface{}{}
+	for _, f := range fields {
+		if v, ok := all[f]; ok {
+			m[f] = v
+		}
+	}
+	return m
+}
+
+func (s *Server) trAdd(r *http.Request, args *trArgs) (interface{}, error) {
+	req := addRequest{Paused: args.Paused}
+	if args.Labels != nil {
+		req.Labels = *args.Labels
+	}
+	if args.DownloadDir != nil {
+		rel, err := s.savePath(r, *args.DownloadDir)
+		if err != nil {
+			return nil, err
+		}
+		req.SavePath = rel
+	}
+	switch {
+	case args.Metainfo != "":
+		req.Torrent = args.Metainfo
+	case strings.HasPrefix(args.Filename, "magnet:"):
+		req.Magnet = args.Filename
+	case args.Filename != "":
+		req.URL = args.Filename
+		if args.Cookies != "" {
+			req.Headers = map[string]string{"Cookie": args.Cookies}
+		}
+	default:
+		return nil, errors.New("no filename or metainfo specified")
+	}
+	result, err := s.add(r, req)
+	if err != nil {
+		return nil, err
+	}
+	t := map[string]interface{}{
+		"id":         s.transmission.id(result.InfoHash),
+		"name":       result.Name,
+		"hashString": result.InfoHash,
+	}
+	if result.Exists {
+		return map[string]interface{}{"torrent-duplicate": t}, nil
+	}
+	return map[string]interface{}{"torrent-added": t}, nil
+}
+
+func (s *Server) trSession(r *http.Request) map[string]interface{} {
+	c := s.engine.Config()
+	encryption := "preferred"
+	if c.DisableEncryption {
+		encryption = "tolerated"
+	}
+	return map[string]interface{}{
+		"version":                    "3.00 (cloud-torrent " + s.state.Stats.Version + ")",
+		"rpc-version":                trRPCVersion,
+		"rpc-version-minimum":        1,
+		"session-id":                 s.transmission.sessionID(),
+		"download-dir":               s.userDownloads(r),
+		"peer-port":                  c.IncomingPort,
+		"dht-enabled":                !c.DisableDHT,
+		"pex-enabled":                !c.DisablePEX,
+		"utp-enabled":                !c.DisableUTP,
+		"lpd-enabled":                c.EnableLSD,
+		"encryption":                 encryption,
+		"start-added-torrents":       true,
+		"peer-limit-per-torrent":     c.MaxConnsPerTorrent,
+		"speed-limit-down-enabled":   false,
+		"speed-limit-up-enabled":     false,
+		"alt-speed-enabled":          false,
+		"seedRatioLimited":           false,
+		"idle-seeding-limit-enabled": false,
+		"incomplete-dir-enabled":     false,
+		"rename-partial-files":       false,
+	}
+}
+
+func (s *Server) trSessionSet(r *http.Request, args *trArgs) error {
+	c := s.engine.Config()
+	//clients echo back the advertised (user's) download dir
+	if args.DownloadDir != nil && *args.DownloadDir != s.userDownloads(r) {
+		c.DownloadDirectory = *args.DownloadDir
+	}
+	if args.PeerPort != nil {
+		c.IncomingPort = *args.PeerPort
+	}
+	if args.DHTEnabled != nil {
+		c.DisableDHT = !*args.DHTEnabled
+	}
+	if args.PEXEnabled != nil {
+		c.DisablePEX = !*args.PEXEnabled
+	}
+	if args.UTPEnabled != nil {
+		c.DisableUTP = !*args.UTPEnabled
+	}
+	if args.LPDEnabled != nil {
+		c.EnableLSD = *args.LPDEnabled
+	}
+	if args.PeerLimitPerTorr != nil {
+		c.MaxConnsPerTorrent = *args.PeerLimitPerTorr
+	}
+	return s.reconfigure(c)
+}
+
+// trSessionStats counts the torrents the request may see
+func (s *Server) trSessionStats(r *http.Request) map[string]interface{} {
+	s.state.Lock()
+	active, paused, rate := 0, 0, float32(0)
+	for _, t := range s.state.Torrents {
+		if !s.owns(r, t) {
+			continue
+		}
+		if t.Started {
+			active++
+		} else {
+			paused++
+		}
+		rate += t.DownloadRate
+	}
+	s.state.Unlock()
+	return map[string]interface{}{
+		"activeTorrentCount": active,
+		"pausedTorrentCount": paused,
+		"torrentCount":       active + paused,
+		"downloadSpeed":      int(rate),
+		"uploadSpeed":        0,
+	}
+}
+
+// trFreeSpace reports the free space of a directory inside the
+// download directory, or the user's folder for non-admins
+func (s *Server) trFreeSpace(r *http.Request, path string) (interface{}, error) {
+	dldir := s.engine.Config().DownloadDirectory
+	if !s.seesAll(r) {
+		dldir = filepath.Join(dldir, s.userDir(r))
+	}
+	if path == "" {
+		path = dldir
+	}
+	rel, err := filepath.Rel(dldir, filepath.Clean(path))
+	if err != nil || (rel != "." && !filepath.IsLocal(rel)) {
+		return nil, fmt.Errorf("Path must be inside %s", dldir)
+	}
+	//folders which don't exist yet use their parent's disk
+	dir := filepath.Join(dldir, rel)
+	for dir != filepath.Dir(dir) {
+		if _, err := os.Stat(dir); err == nil {
+			break
+		}
+		dir = filepath.Dir(dir)
+	}
+	u, err := disk.Usage(dir)
+	if err != nil {
+		return nil, err
+	}
+	return map[string]interface{}{"path": path, "size-bytes": u.Free}, nil
+}
@@ -0,0 +1,96 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"github.com/jpillora/cloud-torrent/engine"
+)
+
+func TestTransmissionUserScope(t *testing.T) {
+	s := newTestServer(t, true)
+	if err := s.users.put("bob", "password123", roleViewer); err != nil {
+		t.Fatal(err)
+	}
+	for _, a := range []struct{ owner, ih string }{
+		{"admin", "c12fe1c06bba254a9dc9f519b335aa7c1367a88a"},
+		{"admin", "d12fe1c06bba254a9dc9f519b335aa7c1367a88a"},
+		{"bob", "e12fe1c06bba254a9dc9f519b335aa7c1367a88a"},
+	} {
+		if _, err := s.engine.AddMagnet("magnet:?xt=urn:btih:"+a.ih, engine.AddOptions{Owner: a.owner, Paused: true}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	s.state.Lock()
+	s.state.Torrents = s.engine.GetTorrents()
+	s.state.Unlock()
+	as := func(name string) *trTester {
+		r := httptest.NewRequest("POST", "/transmission/rpc", nil)
+		return &trTester{t: t, s: s, r: withUser(r, s.users.get(name))}
+	}
+	admin, bob := as("admin"), as("bob")
+	if n := admin.call("session-stats", trArgs{})["torrentCount"]; n != 3 {
+		t.Fatalf("expected admins to count 3 torrents, got %v", n)
+	}
+	if n := bob.call("session-stats", trArgs{})["torrentCount"]; n != 1 {
+		t.Fatalf("expected bob to count 1 torrent, got %v", n)
+	}
+	dldir := s.engine.Config().DownloadDirectory
+	for _, c := range []struct {
+		tr   *trTester
+		path string
+		ok   bool
+	}{
+		{admin, "", true},
+		{admin, dldir, true},
+		{admin, filepath.Join(dldir, "bob", "new"), true},
+		{admin, "/etc", false},
+		{bob, "", true},
+		{bob, filepath.Join(dldir, "bob"), true},
+		{bob, dldir, false},
+		{bob, filepath.Join(dldir, "admin"), false},
+		{bob, filepath.Join(dldir, "bob", "..", "admin"), false},
+		{bob, "/", false},
+	} {
+		_, err := s.transmissionCall(c.tr.r, "free-space", &trArgs{Path: c.path})
+		if (err == nil) != c.ok {
+			t.Fatalf("free-space %q as %s: expected ok %v, got %v", c.path, requestUser(c.tr.r).Name, c.ok, err)
+		}
+	}
+	//the advertised default is the user's folder, which save paths accept
+	for _, tr := range []*trTester{admin, bob} {
+		name := requestUser(tr.r).Name
+		dir, _ := tr.call("session-get", trArgs{})["download-dir"].(string)
+		if want := filepath.Join(dldir, name); dir != want {
+			t.Fatalf("expected %s's download-dir %s, got %s", name, want, dir)
+		}
+		if _, err := s.savePath(tr.r, dir); err != nil {
+			t.Fatalf("expected %s's download-dir to be a valid save path: %s", name, err)
+		}
+	}
+	//and echoing it back leaves the download directory alone
+	echo := filepath.Join(dldir, "admin")
+	if _, err := s.transmissionCall(admin.r, "session-set", &trArgs{DownloadDir: &echo}); err != nil {
+		t.Fatal(err)
+	}
+	if d := s.engine.Config().DownloadDirectory; d != dldir {
+		t.Fatalf("expected download directory %s, got %s", dldir, d)
+	}
+}
+
+type trTester struct {
+	t *testing.T
+	s *Server
+	r *http.Request
+}
+
+func (tr *trTester) call(method string, args trArgs) map[string]interface{} {
+	tr.t.Helper()
+	result, err := tr.s.transmissionCall(tr.r, method, &args)
+	if err != nil {
+		tr.t.Fatal(err)
+	}
+	return result.(map[string]interface{})
+}
@@ -0,0 +1,364 @@
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// user roles, each includes the permissions of those before it
+const (
+	roleViewer   = "viewer"   //read-only, download files
+	roleOperator = "operator" //add and manage torrents
+	roleAdmin    = "admin"    //configuration and users
+)
+
+var roleLevels = map[string]int{roleViewer: 1, roleOperator: 2, roleAdmin: 3}
+
+type user struct {
+	Name string `json:"name"`
+	Hash string `json:"hash,omitempty"`
+	Role string `json:"role"`
+}
+
+// users is the user store, persisted as json with
+// bcrypt hashed passwords
+type users struct {
+	mut   sync.RWMutex
+	path  string
+	users map[string]*user
+}
+
+func loadUsers(path string) (*users, error) {
+	u := &users{path: path, users: map[string]*user{}}
+	b, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return u, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("Read users error: %s", err)
+	}
+	list := []*user{}
+	if len(b) > 0 {
+		if err := json.Unmarshal(b, &list); err != nil {
+			return nil, fmt.Errorf("Malformed users file: %s", err)
+		}
+	}
+	for _, usr := range list {
+		if _, ok := roleLevels[usr.Role]; !ok {
+			return nil, fmt.Errorf("User %s has invalid role %q", usr.Name, usr.Role)
+		}
+		u.users[usr.Name] = usr
+	}
+	return u, nil
+}
+
+// save writes the store atomically, must hold the lock
+func (u *users) save() error {
+	list := []*user{}
+	for _, usr := range u.users {
+		list = append(list, usr)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Name < list[j].Name
+	})
+	b, _ := json.MarshalIndent(list, "", "  ")
+	tmp := u.path + ".tmp"
+	if err := os.WriteFile(tmp, b, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, u.path)
+}
+
+// dummyHash keeps failed logins of unknown
+// users as slow as those of known users
+var dummyHash, _ = bcrypt.GenerateFromPassword([]byte("dummy"), bcrypt.DefaultCost)
+
+// verify returns the user with the given credentials
+func (u *users) verify(name, pass string) *user {
+	usr := u.get(name)
+	hash := dummyHash
+	if usr != nil {
+		hash = []byte(usr.Hash)
+	}
+	if bcrypt.CompareHashAndPassword(hash, []byte(pass)) != nil || usr == nil {
+		return nil
+	}
+	return usr
+}
+
+// get returns a copy of the named user, or nil
+func (u *users) get(name string) *user {
+	u.mut.RLock()
+	defer u.mut.RUnlock()
+	usr, ok := u.users[name]
+	if !ok {
+		return nil
+	}
+	c := *usr
+	return &c
+}
+
+// list returns all users without their hashes
+func (u *users) list() []user {
+	u.mut.RLock()
+	defer u.mut.RUnlock()
+	list := []user{}
+	for _, usr := range u.users {
+		list = append(list, user{Name: usr.Name, Role: usr.Role})
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Name < list[j].Name
+	})
+	return list
+}
+
+// put creates or updates a user, empty fields
+// of existing users are left unchanged
+func (u *users) put(name, pass, role string) error {
+	if name == "" || strings.ContainsAny(name, ":/ ") {
+		return fmt.Errorf("Invalid user name")
+	}
+	if _, ok := roleLevels[role]; role != "" && !ok {
+		return fmt.Errorf("Invalid role %q (admin, operator or viewer)", role)
+	}
+	u.mut.Lock()
+	defer u.mut.Unlock()
+	usr, exists := u.users[name]
+	if !exists {
+		if pass == "" || role == "" {
+			return fmt.Errorf("New users require a password and role")
+		}
+		usr = &user{Name: name}
+	}
+	next := *usr
+	if pass != "" {
+		hash, err := bcrypt.GenerateFromPassword([]byte(pass), bcrypt.DefaultCost)
+		if err != nil {
+			return err
+		}
+		next.Hash = string(hash)
+	}
+	if role != "" {
+		if usr.Role == roleAdmin && role != roleAdmin && u.admins() == 1 {
+			return fmt.Errorf("Cannot demote the last admin")
+		}
+		next.Role = role
+	}
+	u.users[name] = &next
+	if err := u.save(); err != nil {
+		u.users[name] = usr
+		if !exists {
+			delete(u.users, name)
+		}
+		return fmt.Errorf("Save users error: %s", err)
+	}
+	return nil
+}
+
+func (u *users) remove(name string) error {
+	u.mut.Lock()
+	defer u.mut.Unlock()
+	usr, ok := u.users[name]
+	if !ok {
+		return fmt.Errorf("Missing user %s", name)
+	}
+	if usr.Role == roleAdmin && u.admins() == 1 {
+		return fmt.Errorf("Cannot remove the last admin")
+	}
+	delete(u.users, name)
+	if err := u.save(); err != nil {
+		u.users[name] = usr
+		return fmt.Errorf("Save users error: %s", err)
+	}
+	return nil
+}
+
+func (u *users) admins() int {
+	n := 0
+	for _, usr := range u.users {
+		if usr.Role == roleAdmin {
+			n++
+		}
+	}
+	return n
+}
+
+// initUsers loads the user store, creating an admin from
+// the Auth setting (or a random password) when it's empty
+func (s *Server) initUsers() error {
+	u, err := loadUsers(s.UsersPath)
+	if err != nil {
+		return err
+	}
+	if len(u.list()) == 0 {
+		name, pass := "admin", ""
+		if s.Auth != "" {
+			name, pass, _ = strings.Cut(s.Auth, ":")
+		}
+		if pass == "" {
+			pass = randomToken(12)
+			log.Printf("Created user '%s' with password: %s", name, pass)
+		}
+		if err := u.put(name, pass, roleAdmin); err != nil {
+			return err
+		}
+	}
+	s.users = u
+	log.Printf("Enabled multi-user authentication (%s)", filepath.Base(s.UsersPath))
+	return nil
+}
+
+func randomToken(n int) string {
+	b := make([]byte, n)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+type userKey struct{}
+
+// requestUser is the authenticated user of a request, nil
+// when multi-user authentication is disabled
+func requestUser(r *http.Request) *user {
+	u, _ := r.Context().Value(userKey{}).(*user)
+	return u
+}
+
+func withUser(r *http.Request, u *user) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), userKey{}, u))
+}
+
+// authEnabled reports whether requests must be authenticated,
+// by password or single sign-on
+func (s *Server) authEnabled() bool {
+	return s.Auth != "" || s.users != nil || s.ProxyAuthHeader != "" || s.OIDCIssuer != ""
+}
+
+// can checks the request's user has at least the given role
+func (s *Server) can(r *http.Request, role string) bool {
+	u := requestUser(r)
+	if s.users == nil || u == nil {
+		//single user (or no) authentication
+		return s.users == nil
+	}
+	return roleLevels[u.Role] >= roleLevels[role]
+}
+
+// requiredRole of a request, the compatibility apis
+// check their methods individually
+func requiredRole(r *http.Request) string {
+	p := r.URL.Path
+	read := r.Method == "GET" || r.Method == "HEAD"
+	switch {
+	case strings.HasPrefix(p, "/search"):
+		if !read {
+			return roleAdmin //replaces the provider config
+		}
+	case strings.HasPrefix(p, "/download/"):
+		if !read {
+			return roleOperator
+		}
+	case p == v1Prefix+"/users" || strings.HasPrefix(p, v1Prefix+"/users/"):
+		return roleAdmin
+	case p == v1Prefix+"/tokens" || strings.HasPrefix(p, v1Prefix+"/tokens/"):
+		return roleViewer //users manage their own tokens
+	case p == v1Prefix+"/sessions" || strings.HasPrefix(p, v1Prefix+"/sessions/"):
+		return roleViewer //users manage their own sessions
+	case p == v1Prefix+"/shares" || strings.HasPrefix(p, v1Prefix+"/shares/"):
+		if r.Method == "POST" {
+			return roleOperator
+		}
+		return roleAdmin //lists and revokes every user's links
+	case p == v1Prefix+"/config" && !read:
+		return roleAdmin
+	case strings.HasPrefix(p, v1Prefix+"/"):
+		if !read {
+			return roleOperator
+		}
+	case p == "/api/configure" || p == "/api/audit":
+		return roleAdmin
+	case strings.HasPrefix(p, "/api/"):
+		return roleOperator
+	}
+	return roleViewer
+}
+
+// v1UsersEnabled guards the user endpoints, which
+// require the multi-user store
+func (s *Server) v1UsersEnabled(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if s.users == nil {
+			v1Fail(w, http.StatusNotFound, fmt.Errorf("Multi-user accounts are disabled"))
+			return
+		}
+		h(w, r)
+	}
+}
+
+func (s *Server) v1ListUsers(w http.ResponseWriter, r *http.Request) {
+	v1Write(w, http.StatusOK, s.users.list())
+}
+
+func (s *Server) v1Me(w http.ResponseWriter, r *http.Request) {
+	u := requestUser(r)
+	if u == nil {
+		v1Write(w, http.StatusOK, &user{Role: roleAdmin})
+		return
+	}
+	v1Write(w, http.StatusOK, &user{Name: u.Name, Role: u.Role})
+}
+
+// userRequest creates or updates a user
+type userRequest struct {
+	Name     string `json:"name"`
+	Password string `json:"password"`
+	Role     string `json:"role"`
+}
+
+func (s *Server) v1PutUser(w http.ResponseWriter, r *http.Request) {
+	req := userRequest{}
+	if !v1Read(w, r, &req) {
+		return
+	}
+	status := http.StatusOK
+	if name := r.PathValue("name"); name != "" {
+		req.Name = name
+		if s.users.get(name) == nil {
+			v1Fail(w, http.StatusNotFound, fmt.Errorf("Missing user %s", name))
+			return
+		}
+	} else if s.users.get(req.Name) != nil {
+		v1Fail(w, http.StatusConflict, fmt.Errorf("User %s already exists", req.Name))
+		return
+	} else {
+		status = http.StatusCreated
+	}
+	if err := s.users.put(req.Name, req.Password, req.Role); err != nil {
+		v1Fail(w, http.StatusBadRequest, err)
+		return
+	}
+	v1Write(w, status, &user{Name: req.Name, Role: s.users.get(req.Name).Role})
+}
+
+func (s *Server) v1DeleteUser(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+	if s.users.get(name) == nil {
+		v1Fail(w, http.StatusNotFound, fmt.Errorf("Missing user %s", name))
+		return
+	}
+	if err := s.users.remove(name); err != nil {
+		v1Fail(w, http.StatusConflict, err)
+		return
+	}
+	v1Write(w, http.StatusNoContent, nil)
+}
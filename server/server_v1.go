@@ -0,0 +1,416 @@
+package server
+
+import (
+	_ "embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/jpillora/cloud-torrent/engine"
+)
+
+const v1Prefix = "/api/v1"
+
+// openapi describes the whole http api, the tests
+// check it matches the handlers
+//
+//go:embed openapi.json
+var openapi []byte
+
+// v1Error is the body of every failed /api/v1 request
+type v1Error struct {
+	Error struct {
+		Status  int    `json:"status"`
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+// v1Route is an /api/v1 endpoint, its pattern
+// is "METHOD /path" relative to the prefix
+type v1Route struct {
+	pattern string
+	handler http.HandlerFunc
+}
+
+// v1Routes are the endpoints of the JSON REST api, each
+// is documented in openapi.json (see server_v1_test.go)
+func (s *Server) v1Routes() []v1Route {
+	return []v1Route{
+		{"GET /openapi.json", func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			w.Write(openapi)
+		}},
+		{"GET /torrents", s.v1ListTorrents},
+		{"POST /torrents", s.v1AddTorrent},
+		{"POST /torrents/bulk", s.v1Bulk},
+		{"GET /torrents/{ih}", s.v1GetTorrent},
+		{"PATCH /torrents/{ih}", s.v1PatchTorrent},
+		{"DELETE /torrents/{ih}", s.v1DeleteTorrent},
+		{"GET /torrents/{ih}/files", s.v1ListFiles},
+		{"PATCH /torrents/{ih}/files", s.v1PatchFile},
+		{"GET /config", s.v1GetConfig},
+		{"PATCH /config", s.v1PatchConfig},
+		{"GET /stats", s.v1GetStats},
+		{"GET /downloads", s.v1ListDownloads},
+		{"DELETE /downloads/{path...}", s.v1DeleteDownload},
+		{"GET /me", s.v1Me},
+		{"GET /users", s.v1UsersEnabled(s.v1ListUsers)},
+		{"POST /users", s.v1UsersEnabled(s.v1PutUser)},
+		{"PATCH /users/{name}", s.v1UsersEnabled(s.v1PutUser)},
+		{"DELETE /users/{name}", s.v1UsersEnabled(s.v1DeleteUser)},
+		{"GET /tokens", s.v1ListTokens},
+		{"POST /tokens", s.v1CreateToken},
+		{"DELETE /tokens/{id}", s.v1RevokeToken},
+		{"GET /sessions", s.v1ListSessions},
+		{"DELETE /sessions/{id}", s.v1RevokeSession},
+		{"GET /shares", s.v1ListShares},
+		{"POST /shares", s.v1CreateShare},
+		{"DELETE /shares/{id}", s.v1RevokeShare},
+	}
+}
+
+// v1Handler serves the JSON REST api, alongside the
+// legacy POST-only actions in server_api.go
+func (s *Server) v1Handler() http.Handler {
+	mux := http.NewServeMux()
+	for _, route := range s.v1Routes() {
+		method, path, _ := strings.Cut(route.pattern, " ")
+		mux.HandleFunc(method+" "+v1Prefix+path, route.handler)
+	}
+	//unmatched requests get json errors too
+	mux.HandleFunc(v1Prefix+"/", func(w http.ResponseWriter, r *http.Request) {
+		var allow []string
+		for _, m := range []string{"GET", "POST", "PATCH", "DELETE"} {
+			rm := r.Clone(r.Context())
+			rm.Method = m
+			if _, p := mux.Handler(rm); p != v1Prefix+"/" {
+				allow = append(allow, m)
+			}
+		}
+		if len(allow) > 0 {
+			w.Header().Set("Allow", strings.Join(allow, ", "))
+			v1Fail(w, http.StatusMethodNotAllowed, fmt.Errorf("Method %s not allowed", r.Method))
+			return
+		}
+		v1Fail(w, http.StatusNotFound, fmt.Errorf("Not found: %s", r.URL.Path))
+	})
+	return mux
+}
+
+func v1Write(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if v != nil {
+		json.NewEncoder(w).Encode(v)
+	}
+}
+
+func v1Fail(w http.ResponseWriter, status int, err error) {
+	e := v1Error{}
+	e.Error.Status = status
+	e.Error.Message = err.Error()
+	v1Write(w, status, &e)
+}
+
+// isV1 reports whether the request is for the rest api
+func isV1(r *http.Request) bool {
+	return r.URL.Path == v1Prefix || strings.HasPrefix(r.URL.Path, v1Prefix+"/")
+}
+
+// httpError writes the error as json on the rest api,
+// and as text everywhere else
+func httpError(w http.ResponseWriter, r *http.Request, msg string, status int) {
+	if isV1(r) {
+		v1Fail(w, status, errors.New(msg))
+		return
+	}
+	http.Error(w, msg, status)
+}
+
+// v1Read decodes the json request body into v
+func v1Read(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+	if err := json.NewDecoder(io.LimitReader(r.Body, 10<<20)).Decode(v); err != nil {
+		v1Fail(w, http.StatusBadRequest, fmt.Errorf("Invalid JSON body: %s", err))
+		return false
+	}
+	return true
+}
+
+// v1Torrent finds the torrent named in the path, or writes a 404
+func (s *Server) v1Torrent(w http.ResponseWriter, r *http.Request) (*engine.Torrent, bool) {
+	ih := strings.ToLower(r.PathValue("ih"))
+	t, ok := s.ownedTorrent(r, ih)
+	if !ok {
+		v1Fail(w, http.StatusNotFound, fmt.Errorf("Missing torrent %s", ih))
+	}
+	return t, ok
+}
+
+// ownedTorrent is a copy of the torrent ih, taken under the
+// state lock, when the request may see it
+func (s *Server) ownedTorrent(r *http.Request, ih string) (*engine.Torrent, bool) {
+	s.state.Lock()
+	defer s.state.Unlock()
+	s.state.Torrents = s.engine.GetTorrents()
+	t, ok := s.state.Torrents[ih]
+	if !ok || !s.owns(r, t) {
+		return nil, false
+	}
+	return s.engine.CopyTorrent(t), true
+}
+
+func (s *Server) v1ListTorrents(w http.ResponseWriter, r *http.Request) {
+	s.state.Lock()
+	s.state.Torrents = s.engine.GetTorrents()
+	list := []*engine.Torrent{}
+	for _, t := range s.state.Torrents {
+		if s.owns(r, t) {
+			list = append(list, s.engine.CopyTorrent(t))
+		}
+	}
+	s.state.Unlock()
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].InfoHash < list[j].InfoHash
+	})
+	v1Write(w, http.StatusOK, list)
+}
+
+func (s *Server) v1AddTorrent(w http.ResponseWriter, r *http.Request) {
+	b, err := io.ReadAll(io.LimitReader(r.Body, 10<<20))
+	if err != nil {
+		v1Fail(w, http.StatusBadRequest, err)
+		return
+	}
+	result, err := s.apiAdd(r, b)
+	if err != nil {
+		v1Fail(w, http.StatusBadRequest, err)
+		return
+	}
+	status := http.StatusCreated
+	if result.Exists {
+		status = http.StatusOK
+	}
+	w.Header().Set("Location", v1Prefix+"/torrents/"+result.InfoHash)
+	v1Write(w, status, result)
+}
+
+func (s *Server) v1Bulk(w http.ResponseWriter, r *http.Request) {
+	req := engine.BulkRequest{}
+	if !v1Read(w, r, &req) {
+		return
+	}
+	if !s.seesAll(r) {
+		req.Owner = s.owner(r)
+	}
+	results, err := s.engine.Bulk(req)
+	if err != nil {
+		v1Fail(w, http.StatusBadRequest, err)
+		return
+	}
+	s.state.Push()
+	v1Write(w, http.StatusOK, results)
+}
+
+func (s *Server) v1GetTorrent(w http.ResponseWriter, r *http.Request) {
+	if t, ok := s.v1Torrent(w, r); ok {
+		v1Write(w, http.StatusOK, t)
+	}
+}
+
+// torrentPatch holds the torrent fields which may be
+// changed, unset fields are left as they are
+type torrentPatch struct {
+	Started  *bool     `json:"started"`
+	Private  *bool     `json:"private"`
+	Labels   *[]string `json:"labels"`
+	MaxConns *int      `json:"maxConns"`
+	WebSeeds []string  `json:"webSeeds"`
+	Recheck  bool      `json:"recheck"`
+}
+
+func (s *Server) v1PatchTorrent(w http.ResponseWriter, r *http.Request) {
+	t, ok := s.v1Torrent(w, r)
+	if !ok {
+		return
+	}
+	p := torrentPatch{}
+	if !v1Read(w, r, &p) {
+		return
+	}
+	defer s.state.Push()
+	ih := t.InfoHash
+	var err error
+	switch {
+	case p.Started != nil && *p.Started && !t.Started:
+		err = s.engine.StartTorrent(ih)
+	case p.Started != nil && !*p.Started && t.Started:
+		err = s.engine.StopTorrent(ih)
+	}
+	if err == nil && p.Private != nil {
+		err = s.engine.SetPrivate(ih, *p.Private)
+	}
+	if err == nil && p.Labels != nil {
+		err = s.engine.SetLabels(ih, *p.Labels)
+	}
+	if err == nil && p.MaxConns != nil {
+		err = s.engine.SetMaxConns(ih, *p.MaxConns)
+	}
+	if err == nil && len(p.WebSeeds) > 0 {
+		err = s.engine.AddWebSeeds(ih, p.WebSeeds)
+	}
+	if err == nil && p.Recheck {
+		err = s.engine.RecheckTorrent(ih)
+	}
+	if err != nil {
+		v1Fail(w, http.StatusConflict, err)
+		return
+	}
+	if c, ok := s.ownedTorrent(r, ih); ok {
+		t = c
+	}
+	v1Write(w, http.StatusOK, t)
+}
+
+func (s *Server) v1DeleteTorrent(w http.ResponseWriter, r *http.Request) {
+	t, ok := s.v1Torrent(w, r)
+	if !ok {
+		return
+	}
+	defer s.state.Push()
+	var err error
+	if r.URL.Query().Get("data") == "true" {
+		err = s.engine.DeleteTorrentData(t.InfoHash)
+	} else {
+		err = s.engine.DeleteTorrent(t.InfoHash)
+	}
+	if err != nil {
+		v1Fail(w, http.StatusConflict, err)
+		return
+	}
+	v1Write(w, http.StatusNoContent, nil)
+}
+
+func (s *Server) v1ListFiles(w http.ResponseWriter, r *http.Request) {
+	t, ok := s.v1Torrent(w, r)
+	if !ok {
+		return
+	}
+	files := t.Files
+	if files == nil {
+		files = []*engine.File{}
+	}
+	v1Write(w, http.StatusOK, files)
+}
+
+// filePatch starts or stops a single file of a torrent
+type filePatch struct {
+	Path    string `json:"path"`
+	Started bool   `json:"started"`
+}
+
+func (s *Server) v1PatchFile(w http.ResponseWriter, r *http.Request) {
+	t, ok := s.v1Torrent(w, r)
+	if !ok {
+		return
+	}
+	p := filePatch{}
+	if !v1Read(w, r, &p) {
+		return
+	}
+	var file *engine.File
+	for _, f := range t.Files {
+		if f != nil && f.Path == p.Path {
+			file = f
+		}
+	}
+	if file == nil {
+		v1Fail(w, http.StatusNotFound, fmt.Errorf("Missing file %s", p.Path))
+		return
+	}
+	defer s.state.Push()
+	var err error
+	if p.Started && !file.Started {
+		err = s.engine.StartFile(t.InfoHash, p.Path)
+	} else if !p.Started && file.Started {
+		err = s.engine.StopFile(t.InfoHash, p.Path)
+	}
+	if err != nil {
+		v1Fail(w, http.StatusConflict, err)
+		return
+	}
+	if c, ok := s.ownedTorrent(r, t.InfoHash); ok {
+		for _, f := range c.Files {
+			if f != nil && f.Path == p.Path {
+				file = f
+			}
+		}
+	}
+	v1Write(w, http.StatusOK, file)
+}
+
+func (s *Server) v1GetConfig(w http.ResponseWriter, r *http.Request) {
+	c := s.engine.Config()
+	if !s.can(r, roleAdmin) {
+		c = c.Redacted()
+	}
+	v1Write(w, http.StatusOK, c)
+}
+
+func (s *Server) v1PatchConfig(w http.ResponseWriter, r *http.Request) {
+	//unset fields keep their current values
+	c := s.engine.Config()
+	if !v1Read(w, r, &c) {
+		return
+	}
+	if err := s.reconfigure(c); err != nil {
+		v1Fail(w, http.StatusBadRequest, err)
+		return
+	}
+	v1Write(w, http.StatusOK, s.engine.Config())
+}
+
+func (s *Server) v1GetStats(w http.ResponseWriter, r *http.Request) {
+	s.state.Lock()
+	stats := s.state.Stats
+	s.state.Unlock()
+	v1Write(w, http.StatusOK, &stats)
+}
+
+func (s *Server) v1ListDownloads(w http.ResponseWriter, r *http.Request) {
+	if !s.seesAll(r) {
+		st := &serverState{}
+		s.updateUserState(s.owner(r), st)
+		v1Write(w, http.StatusOK, st.Downloads)
+		return
+	}
+	s.state.Lock()
+	root := s.state.Downloads
+	s.state.Unlock()
+	v1Write(w, http.StatusOK, root)
+}
+
+func (s *Server) v1DeleteDownload(w http.ResponseWriter, r *http.Request) {
+	if !s.state.Config.FileStorage() {
+		v1Fail(w, http.StatusMethodNotAllowed, fmt.Errorf("Delete the torrent to remove its data (%s storage)", s.state.Config.Storage))
+		return
+	}
+	file, ok := s.downloadPath(r.PathValue("path"))
+	if !ok || !s.ownsPath(r, r.PathValue("path")) {
+		v1Fail(w, http.StatusBadRequest, fmt.Errorf("Invalid path"))
+		return
+	}
+	if _, err := os.Stat(file); errors.Is(err, os.ErrNotExist) {
+		v1Fail(w, http.StatusNotFound, fmt.Errorf("File not found"))
+		return
+	}
+	if err := os.RemoveAll(file); err != nil {
+		v1Fail(w, http.StatusInternalServerError, fmt.Errorf("Delete failed: %s", err))
+		return
+	}
+	v1Write(w, http.StatusNoContent, nil)
+}
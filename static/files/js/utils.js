@@ -1,4 +1,21 @@
-/* globals app,window */
+/* globals app,window,document */
+
+//send the csrf token of the session (from its cookie) with each request
+app.factory("csrf", function() {
+  return {
+    request: function(config) {
+      var m = /(?:^|;\s*)cloudtorrent-csrf=([^;]*)/.exec(document.cookie);
+      if (m) {
+        config.headers["X-CSRF-Token"] = m[1];
+      }
+      return config;
+    }
+  };
+});
+
+app.config(function($httpProvider) {
+  $httpProvider.interceptors.push("csrf");
+});
 
 app.factory("api", function($rootScope, $http, reqerr) {
   window.http = $http;